@@ -0,0 +1,94 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+)
+
+// cacheCmd manages the preguide cache. The only subcommand is prune, which
+// removes checkpoints (see gen -checkpoint). The flags of cacheCmd other than
+// -all and -max-size are a subset of those of genCmd, and set the
+// corresponding fields of genCmd.
+type cacheCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+	fAll         *bool
+	fMaxSize     *int
+}
+
+func newCacheCmd(r *runner) *cacheCmd {
+	res := &cacheCmd{
+		runner: r,
+	}
+	gc := r.genCmd
+	res.flagDefaults = newFlagSet("preguide cache prune", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fAll = fs.Bool("all", false, "remove all checkpoints")
+		fs.StringVar(gc.fExecutor, "executor", *gc.fExecutor, fmt.Sprintf("the backend used to run containers. Valid values are: %v, %v", executorDocker, executorPodman))
+		res.fMaxSize = fs.Int("max-size", defaultCheckpointMaxSize, "the maximum total size in megabytes of the checkpoints that remain; the least recently used checkpoints are removed")
+	})
+	return res
+}
+
+func (cc *cacheCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide cache prune
+
+Prune removes the records of checkpoints the images of which no longer exist,
+and then the least recently used checkpoints in excess of -max-size.
+
+%s`[1:], cc.flagDefaults)
+}
+
+func (cc *cacheCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), cc}
+}
+
+func (cc *cacheCmd) run(args []string) error {
+	if len(args) == 0 {
+		return cc.usageErr("missing subcommand")
+	}
+	if args[0] != "prune" {
+		return cc.usageErr("unknown subcommand: %v", args[0])
+	}
+	if err := cc.fs.Parse(args[1:]); err != nil {
+		return cc.usageErr("failed to parse flags: %v", err)
+	}
+	if len(cc.fs.Args()) > 0 {
+		return cc.usageErr("unexpected arguments: %v", cc.fs.Args())
+	}
+	if *cc.fMaxSize < 0 {
+		return cc.usageErr("invalid value for -max-size; must be >= 0")
+	}
+	gc := cc.genCmd
+	if *gc.fExecutor == executorLocal {
+		return cc.usageErr("checkpoints are not supported by the %v executor", executorLocal)
+	}
+	var err error
+	gc.executor, err = newExecutor(*gc.fExecutor)
+	if err != nil {
+		return cc.usageErr("invalid value for -executor: %v", err)
+	}
+	maxSize := int64(*cc.fMaxSize) << 20
+	if *cc.fAll {
+		maxSize = -1
+	}
+	removed, errs := pruneCheckpoints(gc.executor, maxSize)
+	for _, c := range removed {
+		fmt.Printf("removed %v (step %v of %v)\n", c.Image, c.Step, cc.relpath(c.Guide))
+	}
+	if len(errs) > 0 {
+		var errBuf bytes.Buffer
+		for _, err := range errs {
+			fmt.Fprintf(&errBuf, "%v\n", err)
+		}
+		raise("%s", errBuf.Bytes())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// A cassette is a directory of recorded prestep requests, one file per
+// request. The -prestep-record flag records the requests made to prestep
+// endpoints (whether those requests are made directly or via a container),
+// and the -prestep-replay flag serves the recorded responses in place of
+// making those requests, allowing guides with presteps to be generated
+// offline and deterministically.
+//
+// The file for a request is named according to a hash of the method, URL
+// and JSON-encoded arguments of the request.
+
+// cassetteEntry is the recording of a single prestep request
+type cassetteEntry struct {
+	Method   string
+	URL      string
+	Args     json.RawMessage `json:",omitempty"`
+	Response string
+}
+
+// cassetteFile returns the path of the file within the cassette dir for the
+// request described by method, url and body
+func cassetteFile(dir, method, url string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\n%v\n%s", method, url, body)
+	return filepath.Join(dir, fmt.Sprintf("%x.json", h.Sum(nil)))
+}
+
+// recordRequest records the response resp for the request described by
+// method, url and body in the cassette dir
+func recordRequest(dir, method, url string, body, resp []byte) {
+	e := cassetteEntry{
+		Method:   method,
+		URL:      url,
+		Response: string(resp),
+	}
+	if body != nil {
+		e.Args = json.RawMessage(bytes.TrimSpace(body))
+	}
+	byts, err := json.MarshalIndent(e, "", "  ")
+	check(err, "failed to encode recording of %v request to %v: %v", method, url, err)
+	err = os.MkdirAll(dir, 0777)
+	check(err, "failed to create prestep recording directory %v: %v", dir, err)
+	fn := cassetteFile(dir, method, url, body)
+	err = os.WriteFile(fn, append(byts, '\n'), 0666)
+	check(err, "failed to write recording of %v request to %v to %v: %v", method, url, fn, err)
+}
+
+// replayRequest returns the response recorded in the cassette dir for the
+// request described by method, url and body. It is an error if no such
+// recording exists.
+func replayRequest(dir, method, url string, body []byte) []byte {
+	fn := cassetteFile(dir, method, url, body)
+	byts, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		raise("no recording in %v for %v request to %v with args %s", dir, method, url, bytes.TrimSpace(body))
+	}
+	check(err, "failed to read recording %v: %v", fn, err)
+	var e cassetteEntry
+	err = json.Unmarshal(byts, &e)
+	check(err, "failed to decode recording %v: %v", fn, err)
+	return []byte(e.Response)
+}
@@ -0,0 +1,398 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/play-with-go/preguide/internal/types"
+)
+
+// A change to any step of a guide results in a cache miss for the whole run,
+// and hence every step being run again from scratch. With -checkpoint, the
+// state of the container that runs the script is committed to an image (a
+// checkpoint) after each step. The image is keyed by the hash of the step,
+// i.e. the hash of the inputs to the run up to and including that step. A
+// later run in which the leading steps are unchanged then resumes from the
+// checkpoint after the last of those steps, running only the steps that
+// follow. The output of the steps that are not run is that of the previous
+// run, as recorded in the out package.
+//
+// Only the file system, the working directory and the exported environment of
+// the script are restored when resuming from a checkpoint. Shell variables
+// that are not exported, and processes, are not. For the same reason, a run
+// can only be checkpointed if it has a single terminal and no presteps (the
+// variables that result from presteps are specific to a run), and a step can
+// only be checkpointed if no long-running statement is running at the end of
+// the step and no statement up to and including the step uses
+// RandomReplace (which affects the sanitisation of later output).
+//
+// Checkpoints are recorded in the user cache directory, and their images
+// count against the limit set by -checkpoint-max-size. The least recently
+// used checkpoints are removed once that limit is exceeded, or by preguide
+// cache prune.
+
+// checkpointRepository is the repository of checkpoint images
+const checkpointRepository = "preguide-checkpoint"
+
+// defaultCheckpointMaxSize is the default maximum total size, in megabytes,
+// of checkpoints
+const defaultCheckpointMaxSize = 10240
+
+// checkpoint is the record of an image that holds the state of the container
+// that runs a guide's script, after a step
+type checkpoint struct {
+	// Hash is the hash of the step after which the checkpoint was taken
+	Hash  string
+	Image string
+
+	// Guide and Step identify the step after which the checkpoint was
+	// taken. They are informational only.
+	Guide string
+	Step  string
+
+	// Dir and Env are the working directory and exported environment of the
+	// script after the step
+	Dir string
+	Env []string
+
+	// Size is the size in bytes of the changes committed to Image
+	Size int64
+
+	// Used is the time at which the checkpoint was taken or last resumed
+	// from
+	Used time.Time
+
+	// index is the index of the step within its run
+	index int
+}
+
+// checkpointsDir returns the directory of checkpoint records
+func checkpointsDir() string {
+	return filepath.Join(cacheDir(), "checkpoints")
+}
+
+// checkpointFile returns the path of the record of the checkpoint with the
+// given hash
+func checkpointFile(hash string) string {
+	return filepath.Join(checkpointsDir(), hash+".json")
+}
+
+// readCheckpoint reads the record of the checkpoint with the given hash. It
+// returns nil if there is no such checkpoint. As with the version cache, a
+// corrupt record is treated as missing.
+func readCheckpoint(hash string) *checkpoint {
+	return readCheckpointFile(checkpointFile(hash))
+}
+
+func readCheckpointFile(fn string) *checkpoint {
+	byts, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	check(err, "failed to read checkpoint %v: %v", fn, err)
+	var c checkpoint
+	if err := json.Unmarshal(byts, &c); err != nil {
+		return nil
+	}
+	return &c
+}
+
+// writeCheckpoint writes the record of the checkpoint c
+func writeCheckpoint(c *checkpoint) {
+	byts, err := json.MarshalIndent(c, "", "  ")
+	check(err, "failed to encode checkpoint %v: %v", c.Image, err)
+	writeCacheFile(checkpointFile(c.Hash), byts)
+}
+
+// listCheckpoints returns the recorded checkpoints, least recently used
+// first
+func listCheckpoints() []*checkpoint {
+	es, err := os.ReadDir(checkpointsDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	check(err, "failed to read checkpoints directory: %v", err)
+	var res []*checkpoint
+	for _, e := range es {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if c := readCheckpointFile(filepath.Join(checkpointsDir(), e.Name())); c != nil {
+			res = append(res, c)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Used.Before(res[j].Used)
+	})
+	return res
+}
+
+// removeCheckpoint removes the record of the checkpoint c, and its image if
+// removeImage
+func removeCheckpoint(e Executor, c *checkpoint, removeImage bool) error {
+	if removeImage {
+		if err := e.RemoveImage(c.Image); err != nil {
+			return fmt.Errorf("failed to remove checkpoint image %v: %v", c.Image, err)
+		}
+	}
+	if err := os.Remove(checkpointFile(c.Hash)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove checkpoint record %v: %v", checkpointFile(c.Hash), err)
+	}
+	return nil
+}
+
+// pruneCheckpoints removes the records of checkpoints the images of which no
+// longer exist, and then the least recently used checkpoints until the total
+// size of those that remain is no more than maxSize bytes. It returns the
+// checkpoints removed, and the errors that resulted for checkpoints that
+// could not be removed (for example because their image is in use).
+func pruneCheckpoints(e Executor, maxSize int64) (removed []*checkpoint, errs []error) {
+	var live []*checkpoint
+	var total int64
+	for _, c := range listCheckpoints() {
+		if e.ImageExists(c.Image) != nil {
+			if err := removeCheckpoint(e, c, false); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			removed = append(removed, c)
+			continue
+		}
+		live = append(live, c)
+		total += c.Size
+	}
+	for _, c := range live {
+		if total <= maxSize {
+			break
+		}
+		if err := removeCheckpoint(e, c, true); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, c)
+		total -= c.Size
+	}
+	return removed, errs
+}
+
+// limitCheckpoints removes the least recently used checkpoints in excess of
+// -checkpoint-max-size. Guides are processed in parallel, hence only one
+// run at a time prunes checkpoints.
+func (pdc *processDirContext) limitCheckpoints() {
+	pdc.checkpointsLock.Lock()
+	defer pdc.checkpointsLock.Unlock()
+	removed, errs := pruneCheckpoints(pdc.executor, int64(*pdc.fCheckpointMaxSize)<<20)
+	for _, c := range removed {
+		pdc.debugf("removed checkpoint %v\n", c.Image)
+	}
+	for _, err := range errs {
+		pdc.debugf("%v\n", err)
+	}
+}
+
+// checkpointable reports, for each step of the run r, whether the state of
+// the container after that step can be checkpointed
+func (pdc *processDirContext) checkpointable(r *guideRun) []bool {
+	res := make([]bool, len(r.steps))
+	if !*pdc.fCheckpoint || pdc.fMode == types.ModeRaw || len(pdc.guide.Terminals) != 1 || len(r.Presteps) > 0 {
+		return res
+	}
+	var blocked, tainted bool
+	for i, s := range r.steps {
+		if s, ok := s.(*commandStep); ok {
+			for _, stmt := range s.Stmts {
+				switch {
+				case stmt.isInterrupt():
+					blocked = false
+				case stmt.isBlocking():
+					blocked = true
+				case stmt.isBackground():
+					tainted = true
+				}
+				if stmt.RandomReplace != nil {
+					tainted = true
+				}
+			}
+		}
+		res[i] = !blocked && !tainted
+	}
+	return res
+}
+
+// resumeFromCheckpoint determines whether the run r, which is not cached,
+// can resume from a checkpoint. out is the previous run, or nil if there is
+// no previous run. r can resume from the checkpoint after a step if that
+// step, and every step before it, is unchanged since out. The latest such
+// checkpoint is used, in which case the script for r is rebuilt to run only
+// the steps that follow.
+func (pdc *processDirContext) resumeFromCheckpoint(r *guideRun, out *guideRun) {
+	if out == nil || !*pdc.fCheckpoint {
+		return
+	}
+	ok := pdc.checkpointable(r)
+	n := 0
+	for ; n < len(r.steps); n++ {
+		s := r.steps[n]
+		o, found := out.Steps[s.name()]
+		if !found || o.hash() != s.hash() {
+			break
+		}
+	}
+	for i := n - 1; i >= 0; i-- {
+		if !ok[i] {
+			continue
+		}
+		c := pdc.lookupCheckpoint(r.steps[i].hash())
+		if c == nil {
+			continue
+		}
+		for _, s := range r.steps[:i+1] {
+			s.setOutputFrom(out.Steps[s.name()])
+		}
+		c.Used = time.Now()
+		writeCheckpoint(c)
+		r.resume = i + 1
+		r.checkpoint = c
+		pdc.runDebugf(r, "resuming from checkpoint %v after step %v\n", c.Image, r.steps[i].name())
+		pdc.buildBashFile(r)
+		return
+	}
+}
+
+// lookupCheckpoint returns the checkpoint with the given hash, or nil if
+// there is no such checkpoint. The record of a checkpoint the image of which
+// no longer exists is removed, in order that the checkpoint is taken again.
+func (pdc *processDirContext) lookupCheckpoint(hash string) *checkpoint {
+	c := readCheckpoint(hash)
+	if c == nil {
+		return nil
+	}
+	if err := pdc.executor.ImageExists(c.Image); err != nil {
+		pdc.debugf("checkpoint image %v no longer exists: %v\n", c.Image, err)
+		err := removeCheckpoint(pdc.executor, c, false)
+		check(err, "%v", err)
+		return nil
+	}
+	return c
+}
+
+// checkpointMarker returns the path, within a terminal's script, of the file
+// with the given suffix used to coordinate the checkpoint after the step at
+// index i. See buildBashFile.
+func checkpointMarker(i int, suffix string) string {
+	return fmt.Sprintf("\"$%v/checkpoint/%v%v\"", scriptsDirVar, i, suffix)
+}
+
+// checkpointer takes the checkpoints of a run as its script runs. The script
+// signals that it has reached a checkpoint by creating the marker file for
+// that checkpoint in dir, having first written its working directory and
+// environment alongside. It then waits until the checkpoint has been taken,
+// signalled by the marker file with the suffix .done.
+type checkpointer struct {
+	executor    Executor
+	dir         string
+	cmd         *containerRunner
+	checkpoints []*checkpoint
+
+	stopc chan struct{}
+	done  chan struct{}
+
+	// panic is the value of any panic that results from taking a
+	// checkpoint
+	panic interface{}
+}
+
+func (pdc *processDirContext) newCheckpointer(dir string, cmd *containerRunner, checkpoints []*checkpoint) *checkpointer {
+	return &checkpointer{
+		executor:    pdc.executor,
+		dir:         dir,
+		cmd:         cmd,
+		checkpoints: checkpoints,
+		stopc:       make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+func (cp *checkpointer) run() {
+	defer func() {
+		// The script will wait forever for a checkpoint that could not be
+		// taken
+		if cp.panic = recover(); cp.panic != nil {
+			cp.cmd.Kill()
+		}
+		close(cp.done)
+	}()
+	for _, c := range cp.checkpoints {
+		marker := filepath.Join(cp.dir, fmt.Sprint(c.index))
+		for {
+			if _, err := os.Stat(marker); err == nil {
+				break
+			}
+			select {
+			case <-cp.stopc:
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		cp.take(c, marker)
+	}
+}
+
+// take takes the checkpoint c, signalled by the marker file marker
+func (cp *checkpointer) take(c *checkpoint, marker string) {
+	dir, err := os.ReadFile(marker + ".dir")
+	check(err, "failed to read working directory for checkpoint after step %v: %v", c.Step, err)
+	env, err := os.ReadFile(marker + ".env")
+	check(err, "failed to read environment for checkpoint after step %v: %v", c.Step, err)
+	c.Dir = strings.TrimSuffix(string(dir), "\n")
+	c.Env = checkpointEnv(env)
+	c.Size, err = cp.executor.Commit(cp.cmd.id(), c.Image)
+	check(err, "failed to checkpoint after step %v: %v", c.Step, err)
+	c.Used = time.Now()
+	writeCheckpoint(c)
+	err = os.WriteFile(marker+".done", nil, 0666)
+	check(err, "failed to signal checkpoint after step %v: %v", c.Step, err)
+}
+
+// stop stops cp once the script has finished, passing on any panic that
+// resulted from taking a checkpoint
+func (cp *checkpointer) stop() {
+	close(cp.stopc)
+	<-cp.done
+	if cp.panic != nil {
+		panic(cp.panic)
+	}
+}
+
+// checkpointEnvName matches the names of variables that can be restored
+// with export
+var checkpointEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// checkpointEnv returns the variables of the NUL-separated environment env
+// to restore when resuming from a checkpoint. The variables that bash
+// maintains, and HOSTNAME (which is specific to a container), are excluded.
+func checkpointEnv(env []byte) []string {
+	var res []string
+	for _, e := range strings.Split(string(env), "\x00") {
+		name := strings.SplitN(e, "=", 2)[0]
+		if !strings.Contains(e, "=") || !checkpointEnvName.MatchString(name) {
+			continue
+		}
+		switch name {
+		case "_", "PWD", "OLDPWD", "SHLVL", "HOSTNAME", "SHELLOPTS", "BASHOPTS":
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
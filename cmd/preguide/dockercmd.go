@@ -5,33 +5,55 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"strings"
+	"time"
+
+	"github.com/play-with-go/preguide"
 )
 
 type dockerCmd struct {
 	*runner
 	fs           *flag.FlagSet
 	flagDefaults string
+
+	// The following flags correspond to the fields of preguide.ServiceConfig
+	// that describe the policy for a request
+
+	fTimeout        *time.Duration
+	fRetries        *int
+	fBackoff        *time.Duration
+	fHeaders        []string
+	fHeadersEnv     *string
+	fBearerTokenEnv *string
 }
 
+// headersEnv is the environment variable via which preguide gen passes the
+// headers for a request to preguide docker
+const headersEnv = "PREGUIDE_HEADERS"
+
 func newDockerCmd(r *runner) *dockerCmd {
 	res := &dockerCmd{
 		runner: r,
 	}
 	res.flagDefaults = newFlagSet("preguide docker", func(fs *flag.FlagSet) {
 		res.fs = fs
+		res.fTimeout = fs.Duration("timeout", 0, "the timeout for each request")
+		res.fRetries = fs.Int("retries", 0, "the number of times to retry a request following a connection error or a 5xx status code")
+		res.fBackoff = fs.Duration("backoff", 0, "the time to wait before the first retry, doubling with each subsequent retry")
+		fs.Var(stringFlagList{&res.fHeaders}, "header", "an HTTP header to add to the request. Format -header=Name:value; can appear multiple times")
+		res.fHeadersEnv = fs.String("headersenv", "", "the environment variable the value of which is a JSON object of HTTP headers to add to the request")
+		res.fBearerTokenEnv = fs.String("bearertokenenv", "", "the environment variable the value of which is sent as a bearer token")
 	})
 	return res
 }
 
 func (dc *dockerCmd) usage() string {
 	return fmt.Sprintf(`
-usage: preguide docker
+usage: preguide docker [METHOD URL [ARGS]]
 
 %s`[1:], dc.flagDefaults)
 }
@@ -48,27 +70,54 @@ func (dc *dockerCmd) run(args []string) error {
 	// where ARGS is a JSON-encoded string. Returns (via stdout) the JSON-encoded result
 	// (without checking that result)
 
-	var body io.Reader
+	if err := dc.fs.Parse(args); err != nil {
+		return dc.usageErr("failed to parse flags: %v", err)
+	}
+	args = dc.fs.Args()
+
+	var body []byte
 
 	switch len(args) {
 	case 2:
 	case 3:
-		body = strings.NewReader(args[2])
+		body = []byte(args[2])
 	default:
 		return dc.usageErr("expected either 2 or 3 args; got %v", len(args))
 	}
 
 	method, url := args[0], args[1]
 
-	req, err := http.NewRequest(method, url, body)
-	check(err, "failed to build a new request for a %v to %v: %v", method, url, err)
-	resp, err := http.DefaultClient.Do(req)
-	check(err, "failed to execute %v on %v: %v", req.Method, req.URL, err)
-	if resp.StatusCode/100 != 2 {
-		raise("got non-success status code (%v) with args [%v]", resp.StatusCode, args)
+	conf := &preguide.ServiceConfig{
+		Timeout:        *dc.fTimeout,
+		Retries:        *dc.fRetries,
+		Backoff:        *dc.fBackoff,
+		Headers:        make(map[string]string),
+		BearerTokenEnv: *dc.fBearerTokenEnv,
+	}
+	for _, h := range dc.fHeaders {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return dc.usageErr("bad value for -header: %q", h)
+		}
+		conf.Headers[parts[0]] = parts[1]
+	}
+	if *dc.fHeadersEnv != "" {
+		v, ok := os.LookupEnv(*dc.fHeadersEnv)
+		if !ok {
+			return dc.usageErr("environment variable %v (specified by -headersenv) is not set", *dc.fHeadersEnv)
+		}
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(v), &headers); err != nil {
+			return dc.usageErr("failed to decode headers from environment variable %v: %v", *dc.fHeadersEnv, err)
+		}
+		for k, v := range headers {
+			conf.Headers[k] = v
+		}
 	}
-	_, err = io.Copy(os.Stdout, resp.Body)
-	check(err, "failed to read response body from %v: %v", req, err)
+	resp, err := prestepRequest(conf, method, url, body)
+	check(err, "failed to execute %v on %v: %v", method, url, err)
+	_, err = os.Stdout.Write(resp)
+	check(err, "failed to write response body from %v on %v: %v", method, url, err)
 
 	return nil
 }
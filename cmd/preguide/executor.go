@@ -0,0 +1,468 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Executor is the backend used to run containers, be that the containers
+// that run the scripts for a guide's terminals, or the containers used to
+// make prestep requests within Docker networks.
+type Executor interface {
+	// ImageExists returns an error if image is not available locally
+	ImageExists(image string) error
+
+	// PullImage pulls image
+	PullImage(image string) error
+
+	// ImageDigest returns the identifier of the content of the local image
+	// image, such that the identifier changes when a tag is moved to a
+	// different image: its repository digest, or its ID if the image was
+	// built locally. The empty string is returned by an executor that does
+	// not use images.
+	ImageDigest(image string) (string, error)
+
+	// Commit commits the current state of the container id to image,
+	// returning the size in bytes of the changes committed, i.e. of the
+	// container's writable layer
+	Commit(id string, image string) (int64, error)
+
+	// RemoveImage removes the local image image
+	RemoveImage(image string) error
+
+	// Create creates (but does not start) a container according to c,
+	// returning the ID of the container
+	Create(c containerConfig) (string, error)
+
+	// CreateNetwork creates the user-defined network name
+	CreateNetwork(name string) error
+
+	// RemoveNetwork removes the network name
+	RemoveNetwork(name string) error
+
+	// ConnectNetwork attaches the container id to network, on which the
+	// container can also be reached by the names in aliases
+	ConnectNetwork(id string, network string, aliases ...string) error
+
+	// Start starts the container id, attaching stdin, stdout and stderr,
+	// and waits for it to complete
+	Start(id string, stdin io.Reader, stdout, stderr io.Writer) error
+
+	// Remove forcibly removes the container id, killing it if it is
+	// running
+	Remove(id string) error
+}
+
+const (
+	executorDocker = "docker"
+	executorPodman = "podman"
+
+	// executorLocal runs the commands for "containers" directly on the
+	// host. See localExecutor.
+	executorLocal = "local"
+)
+
+const (
+	// localRootEnv is the name of the environment variable that holds,
+	// for a command run by the local executor, the path of the scratch
+	// directory that stands in for the root of the container's file system
+	localRootEnv = "PREGUIDE_LOCAL_ROOT"
+
+	// localHome is the home directory, relative to the scratch root, of a
+	// command run by the local executor. It matches the home directory of
+	// the user in the images used by play-with-go guides.
+	localHome = "/home/gopher"
+)
+
+// testExecutors are the executors, by name, that are only available to the
+// preguide tests. See main_test.go.
+var testExecutors = make(map[string]func() Executor)
+
+// newExecutor returns the Executor with the given name
+func newExecutor(name string) (Executor, error) {
+	switch name {
+	case executorDocker, executorPodman:
+		return &cliExecutor{bin: name}, nil
+	case executorLocal:
+		return newLocalExecutor()
+	}
+	if f, ok := testExecutors[name]; ok {
+		return f(), nil
+	}
+	return nil, fmt.Errorf("unknown executor %q", name)
+}
+
+// containerConfig describes a container to be created by an Executor
+type containerConfig struct {
+	Image string
+
+	// Cmd is the command (and its arguments) run in the container
+	Cmd []string
+
+	// Env is the environment of the container. An entry of the form
+	// NAME (rather than NAME=value) passes through the value of NAME in
+	// the environment of preguide
+	Env []string
+
+	// SecretEnv are additional environment variables for the container, of
+	// the form NAME=value, the values of which do not appear in the
+	// arguments used to create the container (which are visible to other
+	// users of the host, e.g. via ps)
+	SecretEnv []string
+
+	Mounts []mount
+
+	// TTY indicates whether to allocate a pseudo-TTY for the container
+	TTY bool
+
+	// Hostname is the hostname of the container. The empty string means
+	// the default of the backend
+	Hostname string
+
+	// AutoRemove indicates whether to remove the container once it
+	// exits
+	AutoRemove bool
+
+	// Args are additional, backend-specific, arguments used when
+	// creating the container, e.g. those supplied via -runargs
+	Args []string
+}
+
+// mount is a bind mount of Source on the host to Target in a container
+type mount struct {
+	Source string
+	Target string
+}
+
+// resolveMount returns the host path that corresponds to the absolute path p
+// within a container, and whether p falls within the target of one of mounts.
+// mounts must be sorted such that the longest target comes first.
+func resolveMount(mounts []mount, p string) (string, bool) {
+	p = path.Clean(p)
+	for _, m := range mounts {
+		if p == m.Target {
+			return m.Source, true
+		}
+		if strings.HasPrefix(p, m.Target+"/") {
+			return filepath.Join(m.Source, strings.TrimPrefix(p, m.Target+"/")), true
+		}
+	}
+	return p, false
+}
+
+// sortMounts sorts mounts such that the longest target comes first, as
+// required by resolveMount
+func sortMounts(mounts []mount) []mount {
+	res := append([]mount{}, mounts...)
+	sort.Slice(res, func(i, j int) bool {
+		return len(res[i].Target) > len(res[j].Target)
+	})
+	return res
+}
+
+// hostEnviron returns the environment for a command run on the host on behalf
+// of the container c, where home is the path to use for HOME. Of the
+// additional arguments in c.Args, we only understand those that set
+// environment variables.
+func hostEnviron(c containerConfig, home string) []string {
+	env := []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + home,
+	}
+	add := func(e string) {
+		if !strings.Contains(e, "=") {
+			v, ok := os.LookupEnv(e)
+			if !ok {
+				return
+			}
+			e = e + "=" + v
+		}
+		env = append(env, e)
+	}
+	for _, e := range c.Env {
+		add(e)
+	}
+	env = append(env, c.SecretEnv...)
+	for i := 0; i < len(c.Args); i++ {
+		switch a := c.Args[i]; {
+		case (a == "-e" || a == "--env") && i+1 < len(c.Args):
+			i++
+			add(c.Args[i])
+		case strings.HasPrefix(a, "--env="):
+			add(strings.TrimPrefix(a, "--env="))
+		}
+	}
+	return env
+}
+
+// crlfWriter translates \n to \r\n in the output written to w, in the same
+// way as a TTY.
+type crlfWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *crlfWriter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.w.Write([]byte(strings.ReplaceAll(string(b), "\n", "\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// cliExecutor is an Executor that uses a Docker-compatible CLI, i.e. docker
+// or podman
+type cliExecutor struct {
+	bin string
+}
+
+var _ Executor = (*cliExecutor)(nil)
+
+func (c *cliExecutor) command(args ...string) *exec.Cmd {
+	return exec.Command(c.bin, args...)
+}
+
+func (c *cliExecutor) ImageExists(image string) error {
+	return c.command("inspect", image).Run()
+}
+
+func (c *cliExecutor) PullImage(image string) error {
+	cmd := c.command("pull", image)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v\n%s", err, out)
+	}
+	return nil
+}
+
+// output runs the CLI with args, returning its trimmed stdout
+func (c *cliExecutor) output(args ...string) (string, error) {
+	return c.cmdOutput(c.command(args...))
+}
+
+// cmdOutput runs cmd, returning its trimmed stdout
+func (c *cliExecutor) cmdOutput(cmd *exec.Cmd) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("failed %v: %v\n%s", cmd, err, stderr.Bytes())
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (c *cliExecutor) ImageDigest(image string) (string, error) {
+	// A pulled image is identified by its repository digest. Only a locally
+	// built image, which has no repository digest, falls back to its ID.
+	return c.output("image", "inspect", "--format", "{{if .RepoDigests}}{{index .RepoDigests 0}}{{else}}{{.Id}}{{end}}", image)
+}
+
+func (c *cliExecutor) Commit(id string, image string) (int64, error) {
+	out, err := c.output("container", "inspect", "--size", "--format", "{{.SizeRw}}", id)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(out, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size of container %v from %q: %v", id, out, err)
+	}
+	if _, err := c.output("commit", id, image); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (c *cliExecutor) RemoveImage(image string) error {
+	_, err := c.output("rmi", image)
+	return err
+}
+
+func (c *cliExecutor) Create(cc containerConfig) (string, error) {
+	cmd := c.command(cliCreateArgs(cc)...)
+	// The CLI passes through the values of the secret environment
+	// variables from its own environment
+	cmd.Env = append(os.Environ(), cc.SecretEnv...)
+	return c.cmdOutput(cmd)
+}
+
+// cliCreateArgs returns the arguments to the create command of a
+// Docker-compatible CLI for the container c
+func cliCreateArgs(c containerConfig) []string {
+	args := []string{"create"}
+	if c.AutoRemove {
+		args = append(args, "--rm")
+	}
+	if c.TTY {
+		args = append(args, "-t")
+	}
+	if c.Hostname != "" {
+		args = append(args, "--hostname", c.Hostname)
+	}
+	for _, m := range c.Mounts {
+		args = append(args, "-v", fmt.Sprintf("%v:%v", m.Source, m.Target))
+	}
+	args = append(args, c.Args...)
+	for _, e := range c.Env {
+		args = append(args, "-e", e)
+	}
+	for _, e := range c.SecretEnv {
+		args = append(args, "-e", strings.SplitN(e, "=", 2)[0])
+	}
+	args = append(args, c.Image)
+	args = append(args, c.Cmd...)
+	return args
+}
+
+func (c *cliExecutor) CreateNetwork(name string) error {
+	_, err := c.output("network", "create", name)
+	return err
+}
+
+func (c *cliExecutor) RemoveNetwork(name string) error {
+	_, err := c.output("network", "rm", name)
+	return err
+}
+
+func (c *cliExecutor) ConnectNetwork(id string, network string, aliases ...string) error {
+	args := []string{"network", "connect"}
+	for _, a := range aliases {
+		args = append(args, "--alias", a)
+	}
+	args = append(args, network, id)
+	cmd := c.command(args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed %v: %v\n%s", cmd, err, out)
+	}
+	return nil
+}
+
+func (c *cliExecutor) Start(id string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd := c.command("start", "-a", id)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+func (c *cliExecutor) Remove(id string) error {
+	cmd := c.command("rm", "-f", id)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed %v: %v\n%s", cmd, err, out)
+	}
+	return nil
+}
+
+// containerRunner is a convenience type used to wrap the three call dance
+// required to run a container with multiple networks attached: create,
+// network connect and start.
+type containerRunner struct {
+	executor Executor
+
+	containerConfig
+
+	Stdin    io.Reader
+	Stdout   io.Writer
+	Stderr   io.Writer
+	Networks []string
+
+	// Aliases are the names, by network, by which the container can be
+	// reached on the networks in Networks
+	Aliases map[string][]string
+
+	// mu guards instance and killed, which allow Kill to be called
+	// concurrently with Run
+	mu       sync.Mutex
+	instance string
+	killed   bool
+}
+
+func (gc *genCmd) newContainerRunner(networks []string, c containerConfig) *containerRunner {
+	return &containerRunner{
+		executor:        gc.executor,
+		containerConfig: c,
+		Networks:        append([]string{}, networks...),
+	}
+}
+
+// String returns a description of the container run by cr, in terms of the
+// arguments to a Docker-compatible CLI
+func (cr *containerRunner) String() string {
+	return strings.Join(cliCreateArgs(cr.containerConfig), " ")
+}
+
+func (cr *containerRunner) Run() error {
+	instance, err := cr.executor.Create(cr.containerConfig)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	cr.instance = instance
+	killed := cr.killed
+	cr.mu.Unlock()
+	if killed {
+		cr.executor.Remove(instance)
+		return fmt.Errorf("container killed before start")
+	}
+
+	for _, network := range cr.Networks {
+		if err := cr.executor.ConnectNetwork(instance, network, cr.Aliases[network]...); err != nil {
+			return err
+		}
+	}
+
+	return cr.executor.Start(instance, cr.Stdin, cr.Stdout, cr.Stderr)
+}
+
+// id returns the ID of the container created by Run, or the empty string if
+// it has not yet been created
+func (cr *containerRunner) id() string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.instance
+}
+
+// Kill kills the container started by Run. It is safe to call Kill
+// concurrently with Run; if the container has not yet been started, it
+// will not be.
+func (cr *containerRunner) Kill() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.killed = true
+	if cr.instance == "" {
+		return nil
+	}
+	// Remove rather than kill, because the container might not yet have
+	// been started
+	if err := cr.executor.Remove(cr.instance); err != nil {
+		return fmt.Errorf("failed to kill %v: %v", cr.instance, err)
+	}
+	return nil
+}
+
+func (cr *containerRunner) CombinedOutput() ([]byte, error) {
+	if cr.Stdout != nil {
+		return nil, fmt.Errorf("cmd Stdout already set")
+	}
+	if cr.Stderr != nil {
+		return nil, fmt.Errorf("cmd Sderr already set")
+	}
+	var comb bytes.Buffer
+	cr.Stdout = &comb
+	cr.Stderr = &comb
+	err := cr.Run()
+	return comb.Bytes(), err
+}
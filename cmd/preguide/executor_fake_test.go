@@ -0,0 +1,412 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// executorFake is the name of the fake executor
+const executorFake = "fake"
+
+// fakeHome is the home directory of the user in a fake container
+const fakeHome = "/home/gopher"
+
+// fakeExecutor is an in-process Executor that does not require a container
+// runtime. It is used by the preguide tests when Docker is not available, in
+// which case preguide is run within the test binary (see TestMain).
+//
+// Containers are only emulated. A script run in a fake container is
+// interpreted in-process by mvdan.cc/sh/v3/interp; any other command is run
+// directly on the host. Absolute paths are resolved to the host path of a
+// mount where they fall within the target of that mount, else to a scratch
+// root directory for the container where they fall within a directory
+// that exists in that root (initially just the home directory). Networks
+// are not emulated at all. Images are only emulated to the extent required
+// for checkpoints: Commit stores a copy of the root of a container under the
+// user cache directory, and a container created from such an image starts
+// with a copy of that root. Any other image is assumed to exist.
+type fakeExecutor struct {
+	mu         sync.Mutex
+	next       int
+	containers map[string]*fakeContainer
+}
+
+var _ Executor = (*fakeExecutor)(nil)
+
+type fakeContainer struct {
+	config containerConfig
+
+	// root is the scratch root directory of the container, once started
+	root string
+
+	// cancel cancels the running of the container
+	cancel context.CancelFunc
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{
+		containers: make(map[string]*fakeContainer),
+	}
+}
+
+func (f *fakeExecutor) ImageExists(image string) error {
+	if !strings.HasPrefix(image, checkpointRepository+":") {
+		return nil
+	}
+	dir, err := fakeImageDir(image)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(dir)
+	return err
+}
+
+func (f *fakeExecutor) PullImage(image string) error {
+	return nil
+}
+
+func (f *fakeExecutor) ImageDigest(image string) (string, error) {
+	return "", nil
+}
+
+func (f *fakeExecutor) Commit(id string, image string) (int64, error) {
+	f.mu.Lock()
+	c, ok := f.containers[id]
+	var root string
+	if ok {
+		root = c.root
+	}
+	f.mu.Unlock()
+	if !ok || root == "" {
+		return 0, fmt.Errorf("no such running container: %v", id)
+	}
+	dir, err := fakeImageDir(image)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return 0, fmt.Errorf("failed to remove existing image %v: %v", image, err)
+	}
+	size, err := copyTree(dir, root)
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit container %v to %v: %v", id, image, err)
+	}
+	return size, nil
+}
+
+func (f *fakeExecutor) RemoveImage(image string) error {
+	dir, err := fakeImageDir(image)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("no such image: %v", image)
+	}
+	return os.RemoveAll(dir)
+}
+
+// fakeImageDir returns the directory that holds the root of the committed
+// image image
+func fakeImageDir(image string) (string, error) {
+	d, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine user cache directory: %v", err)
+	}
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(image)
+	return filepath.Join(d, "preguide", "fake-images", name), nil
+}
+
+// copyTree copies the directory tree rooted at src to dst, returning the
+// total size of the regular files copied
+func copyTree(dst, src string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case d.Type()&fs.ModeSymlink != 0:
+			l, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(l, target)
+		case d.Type().IsRegular():
+			byts, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			size += int64(len(byts))
+			return os.WriteFile(target, byts, info.Mode().Perm())
+		}
+		return nil
+	})
+	return size, err
+}
+
+func (f *fakeExecutor) Create(c containerConfig) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	id := fmt.Sprintf("fake%v", f.next)
+	f.containers[id] = &fakeContainer{config: c}
+	return id, nil
+}
+
+func (f *fakeExecutor) CreateNetwork(name string) error {
+	return nil
+}
+
+func (f *fakeExecutor) RemoveNetwork(name string) error {
+	return nil
+}
+
+func (f *fakeExecutor) ConnectNetwork(id string, network string, aliases ...string) error {
+	_, err := f.container(id)
+	return err
+}
+
+func (f *fakeExecutor) container(id string) (*fakeContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %v", id)
+	}
+	return c, nil
+}
+
+func (f *fakeExecutor) Remove(id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %v", id)
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+	delete(f.containers, id)
+	return nil
+}
+
+func (f *fakeExecutor) Start(id string, stdin io.Reader, stdout, stderr io.Writer) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f.mu.Lock()
+	c, ok := f.containers[id]
+	if ok {
+		c.cancel = cancel
+	}
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such container: %v", id)
+	}
+	if c.config.AutoRemove {
+		defer f.Remove(id)
+	}
+
+	root, err := os.MkdirTemp("", "preguide-fake-container-")
+	if err != nil {
+		return fmt.Errorf("failed to create root for container %v: %v", id, err)
+	}
+	defer os.RemoveAll(root)
+	image, err := fakeImageDir(c.config.Image)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(image); err == nil {
+		if _, err := copyTree(root, image); err != nil {
+			return fmt.Errorf("failed to create root for container %v from image %v: %v", id, c.config.Image, err)
+		}
+	} else if err := os.MkdirAll(filepath.Join(root, fakeHome), 0777); err != nil {
+		return fmt.Errorf("failed to create home for container %v: %v", id, err)
+	}
+	f.mu.Lock()
+	c.root = root
+	f.mu.Unlock()
+
+	if c.config.TTY {
+		// Like a TTY, translate \n to \r\n. Also like a TTY, stderr is
+		// combined with stdout
+		stdout = &crlfWriter{w: stdout}
+		stderr = stdout
+	}
+	fs := &fakeFS{
+		root:   root,
+		mounts: sortMounts(c.config.Mounts),
+	}
+	env := hostEnviron(c.config, fakeHome)
+
+	if len(c.config.Cmd) == 0 {
+		return fmt.Errorf("no command specified for container %v", id)
+	}
+	cmd := c.config.Cmd
+	hostPath := fs.resolve(cmd[0])
+	if isShellScript(hostPath) {
+		return fs.runScript(ctx, hostPath, cmd[1:], env, stdin, stdout, stderr)
+	}
+	ec := exec.CommandContext(ctx, hostPath, fs.resolveArgs(cmd[1:])...)
+	ec.Dir = fs.resolve(fakeHome)
+	ec.Env = env
+	ec.Stdin = stdin
+	ec.Stdout = stdout
+	ec.Stderr = stderr
+	return ec.Run()
+}
+
+// isShellScript reports whether the file at path is a bash or sh script
+func isShellScript(path string) bool {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	line := string(b)
+	if i := strings.Index(line, "\n"); i != -1 {
+		line = line[:i]
+	}
+	return strings.HasPrefix(line, "#!") && (strings.Contains(line, "bash") || strings.HasSuffix(line, "/sh"))
+}
+
+// fakeFS resolves paths within a fake container to paths on the host
+type fakeFS struct {
+	root   string
+	mounts []mount
+}
+
+// resolve returns the host path that corresponds to path p within the
+// container.
+func (fs *fakeFS) resolve(p string) string {
+	if !path.IsAbs(p) {
+		return p
+	}
+	p, ok := resolveMount(fs.mounts, p)
+	if ok {
+		return p
+	}
+	first := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+	if _, err := os.Stat(filepath.Join(fs.root, first)); err == nil {
+		return filepath.Join(fs.root, p)
+	}
+	return p
+}
+
+// resolveIn returns the host path that corresponds to path p within the
+// container, relative to the working directory of the interpreter handler
+// context ctx. Interpreter handlers are passed paths relative to that
+// directory, which is a path within the container.
+func (fs *fakeFS) resolveIn(ctx context.Context, p string) string {
+	if p != "" && !path.IsAbs(p) {
+		p = path.Join(interp.HandlerCtx(ctx).Dir, p)
+	}
+	return fs.resolve(p)
+}
+
+// resolveArgs resolves any absolute paths in args
+func (fs *fakeFS) resolveArgs(args []string) []string {
+	res := make([]string, len(args))
+	for i, a := range args {
+		res[i] = fs.resolve(a)
+	}
+	return res
+}
+
+// runScript interprets the script at the host path script
+func (fs *fakeFS) runScript(ctx context.Context, script string, args []string, env []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	f, err := os.Open(script)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	file, err := syntax.NewParser().Parse(f, script)
+	if err != nil {
+		return fmt.Errorf("failed to parse %v: %v", script, err)
+	}
+	r, err := interp.New(
+		interp.Params(args...),
+		interp.Env(expand.ListEnviron(env...)),
+		interp.StdIO(stdin, stdout, stderr),
+		interp.OpenHandler(func(ctx context.Context, p string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			return interp.DefaultOpenHandler()(ctx, fs.resolveIn(ctx, p), flag, perm)
+		}),
+		interp.StatHandler(func(ctx context.Context, name string, followSymlinks bool) (os.FileInfo, error) {
+			return interp.DefaultStatHandler()(ctx, fs.resolveIn(ctx, name), followSymlinks)
+		}),
+		interp.ReadDirHandler(func(ctx context.Context, p string) ([]os.FileInfo, error) {
+			return interp.DefaultReadDirHandler()(ctx, fs.resolveIn(ctx, p))
+		}),
+		interp.ExecHandler(func(ctx context.Context, args []string) error {
+			hc := interp.HandlerCtx(ctx)
+			var cmdEnv []string
+			hc.Env.Each(func(name string, vr expand.Variable) bool {
+				if vr.Exported {
+					cmdEnv = append(cmdEnv, name+"="+vr.String())
+				}
+				return true
+			})
+			name := args[0]
+			if strings.Contains(name, "/") {
+				name = fs.resolve(name)
+			} else if p, err := exec.LookPath(name); err == nil {
+				name = p
+			} else {
+				fmt.Fprintf(hc.Stderr, "%v: command not found\n", args[0])
+				return interp.NewExitStatus(127)
+			}
+			cmd := exec.CommandContext(ctx, name, fs.resolveArgs(args[1:])...)
+			cmd.Args[0] = args[0]
+			cmd.Dir = fs.resolve(hc.Dir)
+			cmd.Env = cmdEnv
+			cmd.Stdin = hc.Stdin
+			cmd.Stdout = hc.Stdout
+			cmd.Stderr = hc.Stderr
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return interp.NewExitStatus(uint8(exitErr.ExitCode()))
+			}
+			return err
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create interpreter for %v: %v", script, err)
+	}
+	// interp.Dir requires a directory that exists on the host, hence we set
+	// the working directory directly
+	r.Dir = fakeHome
+	if err := r.Run(ctx, file); err != nil {
+		if status, ok := interp.IsExitStatus(err); ok {
+			return fmt.Errorf("exit status %v", status)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+//go:build !(aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris)
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// newLocalExecutor returns an error: the local executor is only available on
+// Unix platforms. See localExecutor.
+func newLocalExecutor() (Executor, error) {
+	return nil, fmt.Errorf("the %v executor is not supported on %v", executorLocal, runtime.GOOS)
+}
@@ -0,0 +1,250 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// localExecutor is an Executor that runs the command for a "container"
+// directly on the host, without any isolation. It exists for fast authoring
+// loops where a container runtime is slow or unavailable.
+//
+// Each container gets a scratch directory that stands in for the root of its
+// file system, with localHome beneath that root used as both HOME and the
+// working directory of its command. The path of the scratch root is
+// available to the command via the variable named by localRootEnv, which
+// is used to remap the absolute targets of a guide's uploads under the
+// scratch root. The command and its arguments are resolved via the
+// container's mounts, such that (for example) a guide's terminal script is
+// run from the scripts directory on the host. Beyond that, absolute paths
+// are those of the host: a command that writes to an absolute path writes
+// to the host. Images, networks and any backend-specific arguments (other
+// than those that set environment variables) are ignored.
+//
+// The command is run in its own session, such that it and any processes it
+// starts can be killed together. Hence the local executor is only available
+// on Unix platforms.
+type localExecutor struct {
+	mu         sync.Mutex
+	next       int
+	containers map[string]*localContainer
+}
+
+var _ Executor = (*localExecutor)(nil)
+
+type localContainer struct {
+	config containerConfig
+
+	// cmd is the running command, if started
+	cmd *exec.Cmd
+
+	// removed indicates the container has been removed
+	removed bool
+}
+
+func newLocalExecutor() (Executor, error) {
+	return &localExecutor{
+		containers: make(map[string]*localContainer),
+	}, nil
+}
+
+func (l *localExecutor) ImageExists(image string) error {
+	return nil
+}
+
+func (l *localExecutor) PullImage(image string) error {
+	return nil
+}
+
+func (l *localExecutor) ImageDigest(image string) (string, error) {
+	return "", nil
+}
+
+func (l *localExecutor) Commit(id string, image string) (int64, error) {
+	return 0, fmt.Errorf("the %v executor does not support images", executorLocal)
+}
+
+func (l *localExecutor) RemoveImage(image string) error {
+	return fmt.Errorf("the %v executor does not support images", executorLocal)
+}
+
+func (l *localExecutor) Create(c containerConfig) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.next++
+	id := fmt.Sprintf("local%v", l.next)
+	l.containers[id] = &localContainer{config: c}
+	return id, nil
+}
+
+func (l *localExecutor) CreateNetwork(name string) error {
+	return nil
+}
+
+func (l *localExecutor) RemoveNetwork(name string) error {
+	return nil
+}
+
+func (l *localExecutor) ConnectNetwork(id string, network string, aliases ...string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.containers[id]; !ok {
+		return fmt.Errorf("no such container: %v", id)
+	}
+	return nil
+}
+
+func (l *localExecutor) Remove(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c, ok := l.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %v", id)
+	}
+	c.removed = true
+	if c.cmd != nil {
+		killSession(c.cmd)
+	}
+	delete(l.containers, id)
+	return nil
+}
+
+func (l *localExecutor) Start(id string, stdin io.Reader, stdout, stderr io.Writer) error {
+	l.mu.Lock()
+	c, ok := l.containers[id]
+	l.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such container: %v", id)
+	}
+	if c.config.AutoRemove {
+		defer l.Remove(id)
+	}
+	if len(c.config.Cmd) == 0 {
+		return fmt.Errorf("no command specified for container %v", id)
+	}
+
+	root, err := os.MkdirTemp("", "preguide-local-root-")
+	if err != nil {
+		return fmt.Errorf("failed to create root for container %v: %v", id, err)
+	}
+	defer os.RemoveAll(root)
+	home := filepath.Join(root, filepath.FromSlash(localHome))
+	tmp := filepath.Join(root, "tmp")
+	for _, d := range []string{home, tmp} {
+		if err := os.MkdirAll(d, 0777); err != nil {
+			return fmt.Errorf("failed to create %v for container %v: %v", d, id, err)
+		}
+	}
+
+	mounts := sortMounts(c.config.Mounts)
+	args := make([]string, len(c.config.Cmd))
+	for i, a := range c.config.Cmd {
+		if path.IsAbs(a) {
+			a, _ = resolveMount(mounts, a)
+		}
+		args[i] = a
+	}
+
+	if c.config.TTY {
+		// Like a TTY, translate \n to \r\n. Also like a TTY, stderr is
+		// combined with stdout
+		stdout = &crlfWriter{w: stdout}
+		stderr = stdout
+	}
+
+	// We use our own pipe for output (rather than having os/exec copy
+	// output) so that we are not blocked by any background processes
+	// that remain once the command exits; they are killed, as they would be
+	// when a container stops. The command is run in its own session so that
+	// we can find such processes, even those in process groups of their own.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe for container %v: %v", id, err)
+	}
+	defer pr.Close()
+	copyDone := make(chan struct{})
+	go func() {
+		io.Copy(stdout, pr)
+		close(copyDone)
+	}()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = home
+	cmd.Env = append(hostEnviron(c.config, home), localRootEnv+"="+root)
+	cmd.Stdin = stdin
+	cmd.Stdout = pw
+	if stderr == stdout {
+		cmd.Stderr = pw
+	} else {
+		cmd.Stderr = stderr
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	l.mu.Lock()
+	if c.removed {
+		l.mu.Unlock()
+		pw.Close()
+		return fmt.Errorf("container %v removed before start", id)
+	}
+	err = cmd.Start()
+	if err == nil {
+		c.cmd = cmd
+	}
+	l.mu.Unlock()
+	if err != nil {
+		pw.Close()
+		return fmt.Errorf("failed to start %v: %v", filepath.Base(args[0]), err)
+	}
+	err = cmd.Wait()
+	killSession(cmd)
+	pw.Close()
+	<-copyDone
+	return err
+}
+
+// killSession kills the processes in the session led by the process of cmd.
+// Where /proc is not available, only the process group led by the process of
+// cmd is killed.
+func killSession(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	sid := cmd.Process.Pid
+	syscall.Kill(-sid, syscall.SIGKILL)
+	procs, _ := os.ReadDir("/proc")
+	for _, p := range procs {
+		pid, err := strconv.Atoi(p.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", p.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The fields that follow the command name (which is in
+		// parentheses) are: state, ppid, pgrp, session
+		i := bytes.LastIndexByte(stat, ')')
+		if i == -1 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) >= 4 && fields[3] == strconv.Itoa(sid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// explain implements gen -explain. For the run r, which is not cached, it
+// prints the inputs to the hash of r that changed compared to the inputs
+// recorded for out, the run of the previous gen. out is nil when there is
+// no previous run.
+//
+// An input is identified by its key. An input is reported as changed when
+// its value differs, added when out has no input with that key, and removed
+// when r has no input with that key.
+func (pdc *processDirContext) explain(r *guideRun, out *guideRun) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v: %v: ", pdc.relpath(pdc.guide.dir), r.fileSuffix())
+	switch {
+	case out == nil:
+		fmt.Fprintf(&b, "no previous run\n")
+	case len(out.HashInputs) == 0:
+		fmt.Fprintf(&b, "hash inputs of previous run not recorded\n")
+	default:
+		prev := make(map[string]*hashInput)
+		for _, hi := range out.HashInputs {
+			prev[hi.Key] = hi
+		}
+		curr := make(map[string]bool)
+		var changes strings.Builder
+		for _, hi := range r.HashInputs {
+			curr[hi.Key] = true
+			switch p := prev[hi.Key]; {
+			case p == nil:
+				fmt.Fprintf(&changes, "\tadded: %v\n", hi.Key)
+				explainValue(&changes, "+", hi.Value)
+			case p.Value != hi.Value:
+				fmt.Fprintf(&changes, "\tchanged: %v\n", hi.Key)
+				explainValue(&changes, "-", p.Value)
+				explainValue(&changes, "+", hi.Value)
+			}
+		}
+		for _, hi := range out.HashInputs {
+			if !curr[hi.Key] {
+				fmt.Fprintf(&changes, "\tremoved: %v\n", hi.Key)
+				explainValue(&changes, "-", hi.Value)
+			}
+		}
+		switch {
+		case changes.Len() > 0:
+			fmt.Fprintf(&b, "hash inputs changed:\n%s", changes.String())
+		case !sameKeyOrder(r.HashInputs, out.HashInputs):
+			fmt.Fprintf(&b, "hash inputs reordered\n")
+		default:
+			// The previous hash does not correspond to its inputs, e.g. the
+			// out package was edited
+			fmt.Fprintf(&b, "hash inputs unchanged\n")
+		}
+	}
+	// Guides are processed in parallel, so we print the explanation for a
+	// run with a single write
+	fmt.Print(b.String())
+}
+
+// explainValue writes each line of the hash input value v to b, prefixed
+// with prefix
+func explainValue(b *strings.Builder, prefix, v string) {
+	for _, l := range strings.Split(v, "\n") {
+		fmt.Fprintf(b, "\t\t%v %v\n", prefix, l)
+	}
+}
+
+// sameKeyOrder reports whether a and b have the same keys in the same order
+func sameKeyOrder(a, b []*hashInput) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key {
+			return false
+		}
+	}
+	return true
+}
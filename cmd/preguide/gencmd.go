@@ -13,9 +13,7 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -95,23 +93,39 @@ type genCmd struct {
 
 	// See the initialisation of the flag fields for comments on their purpose
 
-	fDir           *string
-	flagDefaults   string
-	fConfigs       []string
-	fOutput        *string
-	fSkipCache     *bool
-	fImageOverride *string
-	fPullImage     *string
-	fDocker        *bool
-	fPackage       *string
-	fDebugCache    *bool
-	fRun           *string
-	fRunArgs       []string
-	fTags          []string
-	fMode          types.Mode
+	fDir               *string
+	flagDefaults       string
+	fConfigs           []string
+	fOutput            *string
+	fSkipCache         *bool
+	fImageOverride     *string
+	fPullImage         *string
+	fImageDigest       *bool
+	fDocker            *bool
+	fExecutor          *string
+	fPackage           *string
+	fDebugCache        *bool
+	fExplain           *bool
+	fRun               *string
+	fRunArgs           []string
+	fTimeout           *time.Duration
+	fPrestepRecord     *string
+	fPrestepReplay     *string
+	fRefreshPresteps   *bool
+	fPrestepVersionTTL *time.Duration
+	fWatch             *bool
+	fWatchInterval     *time.Duration
+	fCheckpoint        *bool
+	fCheckpointMaxSize *int
+	fTags              []string
+	fMode              types.Mode
 
 	fParallel *int
 
+	// executor is the backend used to run containers, as specified by
+	// -executor
+	executor Executor
+
 	// dir is the absolute path of the working directory specified by -dir
 	// (if specified)
 	dir string
@@ -133,6 +147,10 @@ type genCmd struct {
 	// cueLock ensures we only ever have a single thread running CUE
 	// code
 	cueLock sync.Mutex
+
+	// checkpointsLock ensures only a single run at a time prunes
+	// checkpoints
+	checkpointsLock sync.Mutex
 }
 
 // getVersion returns the current version returned by the endpoint configured
@@ -193,15 +211,26 @@ func (pdc *processDirContext) getVersion(pkg string) string {
 	if !ok {
 		raise("no config found for prestep %v", pkg)
 	}
-	if conf.Endpoint.Scheme == "file" {
-		version = "file"
-	} else {
-		version = string(pdc.doRequest("GET", conf.Endpoint.String()+"?get-version=1", conf))
-	}
+	version = pdc.resolveVersion(pkg, conf).Version
 
 	return version
 }
 
+// fetchVersion requests the current version of the prestep package pkg
+// from its endpoint, conf.Endpoint
+func (gc *genCmd) fetchVersion(pkg string, conf *preguide.ServiceConfig) string {
+	switch conf.Endpoint.Scheme {
+	case "file":
+		return "file"
+	case "exec":
+		out, err := execPrestep(conf, nil, "--version")
+		check(err, "failed to get version from exec endpoint %v: %v", conf.Endpoint, err)
+		return strings.TrimSpace(string(out))
+	default:
+		return string(gc.doRequest("GET", conf.Endpoint.String()+"?get-version=1", conf))
+	}
+}
+
 type processDirContext struct {
 	*genCmd
 	guideDir string
@@ -234,11 +263,27 @@ func newGenCmd(r *runner) *genCmd {
 		res.fSkipCache = fs.Bool("skipcache", os.Getenv("PREGUIDE_SKIP_CACHE") == "true", "whether to skip any output cache checking")
 		res.fImageOverride = fs.String("image", os.Getenv("PREGUIDE_IMAGE_OVERRIDE"), "the image to use instead of the guide-specified image")
 		res.fPullImage = fs.String("pull", os.Getenv("PREGUIDE_PULL_IMAGE"), "try and docker pull image if missing")
+		res.fImageDigest = fs.Bool("image-digest", true, "include the digest of the image used to run each terminal in the cache check, such that a tag that has moved to a different image is a cache miss. A missing image is pulled according to -pull. Use -image-digest=false to check the cache without a container runtime, e.g. offline")
 		res.fDocker = fs.Bool("docker", false, "internal flag: run prestep requests in a docker container")
+		executor := os.Getenv("PREGUIDE_EXECUTOR")
+		if executor == "" {
+			executor = executorDocker
+		}
+		res.fExecutor = fs.String("executor", executor, fmt.Sprintf("the backend used to run containers. Valid values are: %v, %v, %v. %v runs scripts directly on the host", executorDocker, executorPodman, executorLocal, executorLocal))
 		res.fPackage = fs.String("package", "", "the CUE package name to use for the generated guide structure file")
 		res.fDebugCache = fs.Bool("debugcache", false, "write a human-readable time-stamp-named file of the guide cache check to the current directory")
+		res.fExplain = fs.Bool("explain", false, "for each guide that is not cached, print the inputs to the cache check that changed since the last run")
 		res.fRun = fs.String("run", envOrVal("PREGUIDE_RUN", "."), "regexp that describes which guides within dir to validate and run")
 		fs.Var(stringFlagList{&res.fRunArgs}, "runargs", "additional arguments to pass to the script that runs for a terminal. Format -run=$terminalName=args...; can appear multiple times")
+		res.fTimeout = fs.Duration("timeout", 0, "the default timeout for each statement of a guide that does not specify a timeout. A value of 0 means no timeout")
+		res.fPrestepRecord = fs.String("prestep-record", "", "record the requests made to prestep endpoints in the specified directory")
+		res.fPrestepReplay = fs.String("prestep-replay", "", "serve the requests made to prestep endpoints from the recordings in the specified directory, rather than making the requests")
+		res.fRefreshPresteps = fs.Bool("refresh-presteps", false, "request the version of each prestep from its endpoint, rather than using any cached version")
+		res.fPrestepVersionTTL = fs.Duration("prestep-version-ttl", time.Hour, "the time for which the version of a prestep, once requested from its endpoint, is cached. A value of 0 disables the cache. Use -refresh-presteps to request a version regardless of the cache")
+		res.fWatch = fs.Bool("watch", false, "after generating, watch the guides for changes and regenerate those guides that change")
+		res.fWatchInterval = fs.Duration("watch-interval", 500*time.Millisecond, "the interval at which -watch checks for changes")
+		res.fCheckpoint = fs.Bool("checkpoint", false, "checkpoint the state of the container after each step, such that a guide that is not cached resumes from the checkpoint after the last unchanged step. Not supported by the local executor")
+		res.fCheckpointMaxSize = fs.Int("checkpoint-max-size", defaultCheckpointMaxSize, "the maximum total size in megabytes of checkpoints; the least recently used checkpoints are removed once exceeded")
 		fs.Var(&res.fMode, "mode", fmt.Sprintf("the output mode. Valid values are: %v, %v, %v", types.ModeJekyll, types.ModeGitHub, types.ModeRaw))
 		res.fParallel = fs.Int("parallel", 0, "allow parallel execution of preguide scripts. The value of this flag is the maximum number of scripts to run simultaneously. By default it is set to the value of GOMAXPROCS")
 		fs.Var(stringFlagList{&res.fTags}, "t", "tags for the CUE load")
@@ -305,6 +350,19 @@ func (gc *genCmd) run(args []string) error {
 		gotDir = true
 		dir = "."
 	}
+	if *gc.fPrestepRecord != "" && *gc.fPrestepReplay != "" {
+		return gc.usageErr("-prestep-record and -prestep-replay are mutually exclusive")
+	}
+	gc.executor, err = newExecutor(*gc.fExecutor)
+	if err != nil {
+		return gc.usageErr("invalid value for -executor: %v", err)
+	}
+	if *gc.fCheckpoint && *gc.fExecutor == executorLocal {
+		return gc.usageErr("-checkpoint is not supported by the %v executor", executorLocal)
+	}
+	if *gc.fCheckpointMaxSize < 0 {
+		return gc.usageErr("invalid value for -checkpoint-max-size; must be >= 0")
+	}
 	if gotDir {
 		gc.dir, err = filepath.Abs(dir)
 		check(err, "failed to derive absolute directory from %q: %v", *gc.fDir, err)
@@ -313,57 +371,35 @@ func (gc *genCmd) run(args []string) error {
 	runRegex, err := regexp.Compile(*gc.fRun)
 	check(err, "failed to compile -run regex %q: %v", *gc.fRun, err)
 
-	// Fallback to env-supplied config if no values supplied via -config flag
-	if len(gc.fConfigs) == 0 {
-		envVals := strings.Split(os.Getenv("PREGUIDE_CONFIG"), ":")
-		for _, v := range envVals {
-			v = strings.TrimSpace(v)
-			if v != "" {
-				gc.fConfigs = append(gc.fConfigs, v)
-			}
-		}
-	}
-
 	gc.schemas, err = preguide.LoadSchemas(gc.context)
 	check(err, "failed to load schemas: %v", err)
 
 	gc.loadConfig()
 
-	// Any args to gen are considered directories to walk
-	var toWalk []string
-	switch {
-	case gotArgs:
-		for _, a := range gc.fs.Args() {
-			fp, err := filepath.Abs(a)
-			check(err, "failed to make arg absolute: %v", err)
-			fi, err := os.Stat(fp)
-			check(err, "failed to stat arg %v: %v", a, err)
-			if !fi.IsDir() {
-				raise("arg %v is not a directory", a)
-			}
-			toWalk = append(toWalk, fp)
-		}
-	case gotDir:
-		// Read the source directory and process each guide (directory)
-		dir, err := filepath.Abs(*gc.fDir)
-		check(err, "failed to make path %q absolute: %v", *gc.fDir, err)
-		es, err := os.ReadDir(dir)
-		check(err, "failed to read directory %v: %v", dir, err)
-		for _, e := range es {
-			if !e.IsDir() {
-				continue
-			}
-			// Like cmd/go we skip hidden dirs
-			if strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "_") || e.Name() == "testdata" {
-				continue
-			}
-			// Check against -run regexp
-			if !runRegex.MatchString(e.Name()) {
-				continue
-			}
-			toWalk = append(toWalk, filepath.Join(dir, e.Name()))
+	if *gc.fWatch {
+		return gc.watch(dirArgs, runRegex, gotArgs, gotDir, nil)
+	}
+
+	guides, errs := gc.processGuides(gc.guideDirs(dirArgs, runRegex), gotArgs)
+	if len(errs) > 0 {
+		var errBuf bytes.Buffer
+		for _, err := range errs {
+			fmt.Fprintf(&errBuf, "%v\n", err)
 		}
+		raise("%s", errBuf.Bytes())
 	}
+	gc.guides = guides
+	if gotDir {
+		gc.writeGuideStructures()
+	}
+	return nil
+}
+
+// processGuides processes the guides in dirs, returning the guides that were
+// successfully processed and the errors that resulted for the others. The
+// Docker phase of processing (processDirPost) only happens if the initial
+// phase (processDirPre) succeeds for every guide.
+func (gc *genCmd) processGuides(dirs []string, mustContainGuide bool) (guides []*guide, errs []error) {
 	// TODO: pending whilst we await cuelang.org/go/... to become thread-safe
 	concurrentyLimit := *gc.fParallel
 	// concurrentyLimit := 1
@@ -371,22 +407,10 @@ func (gc *genCmd) run(args []string) error {
 	for i := 0; i < concurrentyLimit; i++ {
 		limiter <- struct{}{}
 	}
-	var errs []error
-	raiseIfErrs := func() {
-		if len(errs) == 0 {
-			return
-		}
-		var errBuf bytes.Buffer
-		for _, err := range errs {
-			fmt.Fprintf(&errBuf, "%v\n", err)
-		}
-		raise("%s", errBuf.Bytes())
-	}
 	var wg sync.WaitGroup
 	var resLock sync.Mutex
-	var guides []*guide
 	var pdcs []*processDirContext
-	for _, d := range toWalk {
+	for _, d := range dirs {
 		pdc := &processDirContext{
 			genCmd:      gc,
 			stmtPrinter: syntax.NewPrinter(syntax.SingleLine(true)),
@@ -408,7 +432,7 @@ func (gc *genCmd) run(args []string) error {
 		}
 	}
 	par(func(pdc *processDirContext) {
-		err := pdc.processDirPre(gotArgs)
+		err := pdc.processDirPre(mustContainGuide)
 		if err != nil {
 			switch err.(type) {
 			case errList:
@@ -422,7 +446,9 @@ func (gc *genCmd) run(args []string) error {
 		}
 	})
 	wg.Wait()
-	raiseIfErrs()
+	if len(errs) > 0 {
+		return nil, errs
+	}
 	par(func(pdc *processDirContext) {
 		if pdc.guide == nil {
 			return
@@ -430,7 +456,12 @@ func (gc *genCmd) run(args []string) error {
 		err := pdc.processDirPost()
 		resLock.Lock()
 		if err != nil {
-			err = fmt.Errorf("%v: %v", pdc.relpath(pdc.guideDir), err)
+			switch err.(type) {
+			case errList:
+				// We already have position information
+			default:
+				err = fmt.Errorf("%v: %v", pdc.relpath(pdc.guideDir), err)
+			}
 			errs = append(errs, err)
 		} else if len(pdc.guide.mdFiles) > 0 {
 			guides = append(guides, pdc.guide)
@@ -438,18 +469,64 @@ func (gc *genCmd) run(args []string) error {
 		resLock.Unlock()
 	})
 	wg.Wait()
-	raiseIfErrs()
-	gc.guides = guides
-	if gotDir {
-		gc.writeGuideStructures()
+	return guides, errs
+}
+
+// guideDirs returns the directories to process as guides. Directory
+// arguments, if provided, are used as is. Otherwise the directories within
+// -dir that match runRegex are used.
+func (gc *genCmd) guideDirs(args []string, runRegex *regexp.Regexp) (res []string) {
+	switch {
+	case len(args) > 0:
+		for _, a := range args {
+			fp, err := filepath.Abs(a)
+			check(err, "failed to make arg absolute: %v", err)
+			fi, err := os.Stat(fp)
+			check(err, "failed to stat arg %v: %v", a, err)
+			if !fi.IsDir() {
+				raise("arg %v is not a directory", a)
+			}
+			res = append(res, fp)
+		}
+	default:
+		// Read the source directory and process each guide (directory)
+		dir, err := filepath.Abs(*gc.fDir)
+		check(err, "failed to make path %q absolute: %v", *gc.fDir, err)
+		es, err := os.ReadDir(dir)
+		check(err, "failed to read directory %v: %v", dir, err)
+		for _, e := range es {
+			if !e.IsDir() {
+				continue
+			}
+			// Like cmd/go we skip hidden dirs
+			if strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "_") || e.Name() == "testdata" {
+				continue
+			}
+			// Check against -run regexp
+			if !runRegex.MatchString(e.Name()) {
+				continue
+			}
+			res = append(res, filepath.Join(dir, e.Name()))
+		}
 	}
-	return nil
+	return res
 }
 
 // loadConfig loads the configuration that drives the gen command. This
 // configuration is described by the PrestepServiceConfig type, which is
 // maintained as the #PrestepServiceConfig CUE definition.
 func (gc *genCmd) loadConfig() {
+	// Fallback to env-supplied config if no values supplied via -config flag
+	if len(gc.fConfigs) == 0 {
+		envVals := strings.Split(os.Getenv("PREGUIDE_CONFIG"), ":")
+		for _, v := range envVals {
+			v = strings.TrimSpace(v)
+			if v != "" {
+				gc.fConfigs = append(gc.fConfigs, v)
+			}
+		}
+	}
+
 	if len(gc.fConfigs) == 0 {
 		return
 	}
@@ -474,8 +551,17 @@ func (gc *genCmd) loadConfig() {
 	err = res.Decode(&gc.config)
 	check(err, "failed to decode config from CUE value: %v", err)
 
-	// Now validate that we don't have any networks for file protocol endpoints
+	// Now validate that we don't have any networks for file protocol
+	// endpoints, nor networks for exec protocol endpoints
 	for ps, conf := range gc.config {
+		if conf.Endpoint.Scheme == "exec" {
+			if execPrestepPath(conf.Endpoint) == "" {
+				raise("prestep %v defined an exec scheme endpoint %v without a path", ps, conf.Endpoint)
+			}
+			if len(conf.Networks) > 0 {
+				raise("prestep %v defined an exec scheme endpoint %v but provided networks [%v]", ps, conf.Endpoint, conf.Networks)
+			}
+		}
 		if conf.Endpoint.Scheme == "file" {
 			if len(conf.Env) > 0 {
 				raise("prestep %v defined a file scheme endpoint %v but provided additional environment variables [%v]", ps, conf.Endpoint, conf.Env)
@@ -497,11 +583,12 @@ func (pdc *processDirContext) processDirPre(mustContainGuide bool) (err error) {
 		target = pdc.guideDir
 	}
 	g := &guide{
-		dir:    pdc.guideDir,
-		name:   filepath.Base(pdc.guideDir),
-		target: target,
-		Steps:  make(map[string]step),
-		varMap: make(map[string]string),
+		dir:         pdc.guideDir,
+		name:        filepath.Base(pdc.guideDir),
+		target:      target,
+		stepsByName: make(map[types.LangCode]steps),
+		steps:       make(map[types.LangCode][]step),
+		Outputs:     make(map[string]map[types.LangCode]*guideRun),
 	}
 
 	// A guide is established by the presence of a CUE package in a directory.
@@ -541,6 +628,10 @@ func (pdc *processDirContext) processDirPost() (err error) {
 
 	pdc.runSteps()
 
+	if err := pdc.validateOutRefDirs(); err != nil {
+		return err
+	}
+
 	pdc.writeGuideOutput()
 
 	pdc.writeLog()
@@ -550,30 +641,19 @@ func (pdc *processDirContext) processDirPost() (err error) {
 
 func (pdc *processDirContext) runSteps() {
 	g := pdc.guide
-	// If we have any steps to run, build a bash file that represents the script
-	// to run. Then check whether the hash representing the contents of the bash
-	// file matches the hash in the out CUE package (i.e. the result of a
-	// previous run of this guide). If the hash matches, we don't have anything
-	// to do: the inputs are identical and hence (because guides should be
-	// idempotent) the output would be the same.
-	if len(g.Steps) == 0 {
-		return
+	// Each run of the guide (i.e. each scenario) is considered in turn. The
+	// out CUE package only needs to be written if the output of at least
+	// one run has changed, or if the set of runs has changed.
+	changed := g.outputGuide == nil || g.outputGuide.numRuns() != len(g.runs)
+	for _, r := range g.runs {
+		if pdc.runStepsFor(r) {
+			changed = true
+		}
 	}
-	pdc.buildBashFile(g)
-	out := g.outputGuide
-	cacheHit := out != nil && out.Hash == g.Hash
-	pdc.debugf("cache hit? %v\n", cacheHit)
-	if !*pdc.fSkipCache && cacheHit {
-		pdc.debugf("cache hit: will not re-run script\n")
-		g.updateFromOutput(out)
+	if len(g.runs) == 0 || !changed {
 		return
 	}
-	pdc.runBashFile(g)
-	if cacheHit && pdc.comparisonEqual(g, out) {
-		g.updateFromOutput(out)
-	} else {
-		pdc.writeOutPackage(g)
-	}
+	pdc.writeOutPackage(g)
 	if pdc.fMode != types.ModeRaw {
 		// This step can be made more efficient if we know there is not
 		// anything else in the out package other than the generated data
@@ -582,7 +662,55 @@ func (pdc *processDirContext) runSteps() {
 	}
 }
 
-func (pdc *processDirContext) comparisonEqual(regen, out *guide) bool {
+// runStepsFor runs the steps for the run r, reporting whether the output
+// of the run differs from that in the out CUE package.
+func (pdc *processDirContext) runStepsFor(r *guideRun) bool {
+	g := pdc.guide
+	// Build a bash file per terminal that represents the script to run. Then
+	// check whether the hash representing the contents of the bash files
+	// matches the hash of the corresponding run in the out CUE package (i.e.
+	// the result of a previous run of this guide). If the hash matches, we
+	// don't have anything to do: the inputs are identical and hence (because
+	// guides should be idempotent) the output would be the same.
+	pdc.buildBashFile(r)
+	var out *guideRun
+	if g.outputGuide != nil {
+		out = g.outputGuide.run(r.scenario.Name, r.lang)
+	}
+	cacheHit := out != nil && out.Hash == r.Hash
+	pdc.runDebugf(r, "cache hit? %v\n", cacheHit)
+	if *pdc.fExplain && !cacheHit {
+		pdc.explain(r, out)
+	}
+	if !*pdc.fSkipCache && cacheHit {
+		pdc.runDebugf(r, "cache hit: will not re-run script\n")
+		r.updateFromOutput(out)
+		return false
+	}
+	if !*pdc.fSkipCache {
+		pdc.resumeFromCheckpoint(r, out)
+	}
+	pdc.runBashFile(r)
+	if len(r.checkpoints) > 0 {
+		pdc.limitCheckpoints()
+	}
+	if cacheHit && pdc.comparisonEqual(r, out) {
+		r.updateFromOutput(out)
+		return false
+	}
+	return true
+}
+
+// runDebugf is like debugf, except that it qualifies the message with the
+// run r when the guide has more than one run
+func (pdc *processDirContext) runDebugf(r *guideRun, format string, args ...interface{}) {
+	if len(pdc.guide.runs) > 1 {
+		format = r.fileSuffix() + ": " + format
+	}
+	pdc.debugf(format, args...)
+}
+
+func (pdc *processDirContext) comparisonEqual(regen, out *guideRun) bool {
 	// At this point we know we had the same input, i.e. a cache hit.
 	// So we can safely iterate each step and simply compare comparison
 	// output
@@ -657,14 +785,7 @@ func (pdc *processDirContext) loadMarkdownFiles(g *guide) bool {
 			continue
 		}
 		// Is this a valid language with respect to the guide?
-		guideLang := false
-		for _, l := range g.langs {
-			if l == lang {
-				guideLang = true
-				break
-			}
-		}
-		if !guideLang {
+		if !g.hasLang(types.LangCode(lang)) {
 			errs.Addf("%v: %q is not a valid language for this guide", pdc.relpath(path), lang)
 		}
 		g.mdFiles = append(g.mdFiles, pdc.buildMarkdownFile(g, path, types.LangCode(lang), ext))
@@ -675,6 +796,22 @@ func (pdc *processDirContext) loadMarkdownFiles(g *guide) bool {
 	if len(g.mdFiles) == 0 {
 		raise("failed to load markdown files")
 	}
+	// Every language of the guide must have a markdown file
+	for _, l := range g.langs {
+		found := false
+		for _, mdf := range g.mdFiles {
+			if mdf.lang == types.LangCode(l) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs.Addf("%v: no markdown file for language %q", pdc.relpath(g.dir), l)
+		}
+	}
+	if errs.Err() != nil {
+		panic(util.KnownErr{Err: errs.Err()})
+	}
 	return true
 }
 
@@ -742,47 +879,61 @@ func (pdc *processDirContext) loadAndValidateSteps(g *guide, mustContainGuide bo
 	g.Delims = intGuide.Delims
 	g.Networks = intGuide.Networks
 	g.Env = intGuide.Env
-	for _, s := range intGuide.Scenarios {
-		g.Scenarios = append(g.Scenarios, s)
+	if intGuide.Timeout != nil {
+		d, err := time.ParseDuration(*intGuide.Timeout)
+		check(err, "failed to parse Timeout %q: %v", *intGuide.Timeout, err)
+		g.timeout = &d
+	}
+
+	// declOrder sorts names, the names of fields in the struct at field,
+	// according to the order in which those fields are declared in the
+	// guide [filename, offset]
+	declOrder := func(field string, names []string) []string {
+		type namePosition struct {
+			name string
+			pos  token.Pos
+		}
+		var positions []namePosition
+		for _, n := range names {
+			path := cue.MakePath(cue.Str(field), cue.Str(n))
+			positions = append(positions, namePosition{
+				name: n,
+				pos:  structPos(g.val.LookupPath(path)),
+			})
+		}
+		sort.Slice(positions, func(i, j int) bool {
+			return posLessThan(positions[i].pos, positions[j].pos)
+		})
+		var res []string
+		for _, p := range positions {
+			res = append(res, p.name)
+		}
+		return res
 	}
 
-	type termPosition struct {
-		name string
-		pos  token.Pos
+	var scenarioNames []string
+	for n := range intGuide.Scenarios {
+		scenarioNames = append(scenarioNames, n)
 	}
-	var termPositions []termPosition
-	if len(intGuide.Terminals) > 1 {
-		raise("we only support a single terminal currently")
+	for _, n := range declOrder("Scenarios", scenarioNames) {
+		g.Scenarios = append(g.Scenarios, intGuide.Scenarios[n])
 	}
+
+	var termNames []string
 	for n := range intGuide.Terminals {
-		path := cue.MakePath(cue.Str("Terminals"), cue.Str(n))
-		termPositions = append(termPositions, termPosition{
-			name: n,
-			pos:  structPos(gv.LookupPath(path)),
-		})
+		termNames = append(termNames, n)
 	}
-	sort.Slice(termPositions, func(i, j int) bool {
-		return posLessThan(termPositions[i].pos, termPositions[j].pos)
-	})
-	for _, tp := range termPositions {
-		n := tp.name
-		t := intGuide.Terminals[n]
-		g.Terminals = append(g.Terminals, t)
-	}
-
-	// Before we release the CUE lock, grab the positions of the steps
-	// which we will use for later sorting
-	type stepPosition struct {
-		name string
-		pos  token.Pos
-	}
-	var stepPositions []stepPosition
-	for stepName := range intGuide.Steps {
-		stepPositions = append(stepPositions, stepPosition{
-			name: stepName,
-			pos:  structPos(g.val.LookupPath(cue.MakePath(cue.Str("Steps"), cue.Str(stepName)))),
-		})
+	for _, n := range declOrder("Terminals", termNames) {
+		g.Terminals = append(g.Terminals, intGuide.Terminals[n])
 	}
+
+	// Before we release the CUE lock, grab the order of the steps
+	var stepNames []string
+	for n := range intGuide.Steps {
+		stepNames = append(stepNames, n)
+	}
+	stepNames = declOrder("Steps", stepNames)
+	pdc.compileExitCodes(g)
 	unlock()
 
 	// Create presteps - but we will check them later
@@ -795,17 +946,105 @@ func (pdc *processDirContext) loadAndValidateSteps(g *guide, mustContainGuide bo
 		if ps.Package == "" {
 			raise("Prestep had empty package")
 		}
-		g.Presteps = append(g.Presteps, &ps)
+		g.presteps = append(g.presteps, &ps)
+	}
+
+	sort.Slice(g.langs, func(i, j int) bool {
+		return g.langs[i] < g.langs[j]
+	})
+
+	// English is required because steps that are not overridden for a
+	// language fall back to their English variant
+	hasEn := false
+	for _, l := range g.langs {
+		if l == "en" {
+			hasEn = true
+		}
+	}
+	if !hasEn {
+		raise("guide languages %v do not include \"en\"", g.langs)
+	}
+
+	// overrides is the set of languages for which at least one step
+	// declares a variant (other than English)
+	overrides := make(map[types.LangCode]bool)
+	for _, stepName := range stepNames {
+		for lang := range intGuide.Steps[stepName] {
+			if !g.hasLang(lang) {
+				raise("step %v declares a variant for language %q, which is not a language of the guide", stepName, lang)
+			}
+			if lang != "en" {
+				overrides[lang] = true
+			}
+		}
+	}
+
+	for _, l := range g.langs {
+		lang := types.LangCode(l)
+		g.stepsByName[lang], g.steps[lang] = pdc.buildSteps(g, intGuide.Steps, stepNames, lang)
+	}
+
+	if len(stepNames) == 0 {
+		return true
+	}
+	if len(g.Scenarios) == 0 {
+		raise("guide declares steps but no scenarios")
+	}
+
+	// The steps of the guide are run once per scenario, for English and
+	// each language that overrides at least one step. Each run has its own
+	// steps and presteps, because each run has its own output
+	for _, scenario := range g.Scenarios {
+		for _, l := range g.langs {
+			lang := types.LangCode(l)
+			if lang != "en" && !overrides[lang] {
+				continue
+			}
+			r := &guideRun{
+				scenario: scenario,
+				lang:     lang,
+				varMap:   make(map[string]string),
+				secrets:  make(map[string]bool),
+			}
+			r.Steps, r.steps = pdc.buildSteps(g, intGuide.Steps, stepNames, lang)
+			for _, ps := range g.presteps {
+				ps := *ps
+				r.Presteps = append(r.Presteps, &ps)
+			}
+			langs, ok := g.Outputs[scenario.Name]
+			if !ok {
+				langs = make(map[types.LangCode]*guideRun)
+				g.Outputs[scenario.Name] = langs
+			}
+			langs[r.lang] = r
+			g.runs = append(g.runs, r)
+		}
 	}
+	return true
+}
 
-	for stepName, v := range intGuide.Steps {
+// buildSteps builds the steps declared in the guide g for the language
+// lang, returning them by name and in the order given by stepNames. Steps
+// that do not declare a variant for lang fall back to their English variant.
+func (pdc *processDirContext) buildSteps(g *guide, intSteps types.Steps, stepNames []string, lang types.LangCode) (steps, []step) {
+	byName := make(steps)
+	var ordered []step
+	for i, stepName := range stepNames {
 		var s step
+		var err error
+		v, ok := intSteps[stepName][lang]
+		if !ok {
+			v = intSteps[stepName]["en"]
+		}
 		switch is := v.(type) {
 		case *types.Command:
 			if is.Path != nil && !filepath.IsAbs(*is.Path) {
 				abs := filepath.Join(g.dir, *is.Path)
 				is.Path = &abs
 			}
+			if is.Path != nil {
+				g.addStepPath(*is.Path)
+			}
 			s, err = pdc.commandStepFromCommand(is)
 			check(err, "failed to parse #Command from step %v: %v", stepName, err)
 		case *types.Upload:
@@ -813,6 +1052,9 @@ func (pdc *processDirContext) loadAndValidateSteps(g *guide, mustContainGuide bo
 				abs := filepath.Join(g.dir, *is.Path)
 				is.Path = &abs
 			}
+			if is.Path != nil {
+				g.addStepPath(*is.Path)
+			}
 			s, err = pdc.uploadStepFromUpload(is)
 			check(err, "failed to parse #Upload from step %v: %v", stepName, err)
 		}
@@ -846,48 +1088,66 @@ func (pdc *processDirContext) loadAndValidateSteps(g *guide, mustContainGuide bo
 				}
 			}
 		}
-		g.Steps[stepName] = s
-	}
-
-	sort.Slice(g.langs, func(i, j int) bool {
-		return g.langs[i] < g.langs[j]
-	})
-
-	// TODO: error on steps for multiple languages until we support
-	// github.com/play-with-go/preguide/issues/64
-	if len(g.langs) > 0 && (len(g.langs) > 2 || g.langs[0] != "en") {
-		raise("we only support steps for English language guides for now")
+		s.setorder(i)
+		byName[stepName] = s
+		ordered = append(ordered, s)
 	}
+	validateInterrupts(ordered)
+	return byName, ordered
+}
 
-	// TODO: error on multiple scenarios until we support
-	// github.com/play-with-go/preguide/issues/64
-	if len(g.Scenarios) > 1 {
-		raise("we only support a single scenario for now")
+// validateInterrupts ensures that each blocking statement is followed by an
+// interrupt statement in the same terminal, and that each interrupt statement
+// follows a blocking statement in the same terminal. Whilst blocked, a
+// terminal cannot be used for anything else.
+func validateInterrupts(steps []step) {
+	type blocked struct {
+		step string
+		stmt int
+	}
+	blockedTerms := make(map[string]*blocked)
+	for _, s := range steps {
+		term := s.terminal()
+		b := blockedTerms[term]
+		cs, ok := s.(*commandStep)
+		if !ok {
+			if b != nil {
+				raise("step %v: terminal %v is blocked by statement %d of step %v; the next statement in that terminal must be an interrupt statement", s.name(), term, b.stmt, b.step)
+			}
+			continue
+		}
+		for i, stmt := range cs.Stmts {
+			switch {
+			case stmt.isInterrupt():
+				if b == nil {
+					raise("step %v: interrupt statement %d does not follow a blocking statement in terminal %v", s.name(), i, term)
+				}
+				b = nil
+			case b != nil:
+				raise("step %v: terminal %v is blocked by statement %d of step %v; the next statement in that terminal must be an interrupt statement", s.name(), term, b.stmt, b.step)
+			case stmt.isBlocking():
+				b = &blocked{step: s.name(), stmt: i}
+			}
+		}
+		blockedTerms[term] = b
 	}
-
-	// Sort according to the order of the steps as declared in the
-	// guide [filename, offset]
-	sort.Slice(stepPositions, func(i, j int) bool {
-		return posLessThan(stepPositions[i].pos, stepPositions[j].pos)
-	})
-	for i, sp := range stepPositions {
-		s := g.Steps[sp.name]
-		g.steps = append(g.steps, s)
-		s.setorder(i)
+	for _, s := range steps {
+		term := s.terminal()
+		if b := blockedTerms[term]; b != nil {
+			raise("step %v: blocking statement %d in terminal %v is not followed by an interrupt statement", b.step, b.stmt, term)
+		}
 	}
-	return true
 }
 
 func (pdc *processDirContext) checkPresteps() {
 	g := pdc.guide
 
 	// We only investigate the presteps if we have any steps
-	// to run
-	if len(g.Steps) == 0 {
-		return
-	}
-	for _, ps := range g.Presteps {
-		ps.Version = pdc.getVersion(ps.Package)
+	// to run, i.e. if we have any runs
+	for _, r := range g.runs {
+		for _, ps := range r.Presteps {
+			ps.Version = pdc.getVersion(ps.Package)
+		}
 	}
 }
 
@@ -960,16 +1220,6 @@ func (pdc *processDirContext) loadOutput(full bool) {
 	}
 	check(err, "failed to decode Guide from out value: %v", errors.Details(err, &errors.Config{Cwd: g.dir}))
 
-	// Set g.steps = nil because at this stage we know we have
-	// valid information in g.Steps
-	g.steps = nil
-	for _, step := range g.Steps {
-		g.steps = append(g.steps, step)
-	}
-	sort.Slice(g.steps, func(i, j int) bool {
-		return g.steps[i].order() < g.steps[j].order()
-	})
-
 	g.outputGuide = &out
 	g.outVal = gv
 }
@@ -984,8 +1234,6 @@ func (pdc *processDirContext) validateStepAndRefDirs() error {
 	defer pdc.cueLock.Unlock()
 
 	g := pdc.guide
-	// TODO: verify that we have identical sets of languages when we support
-	// multiple languages
 	var errs errList
 
 	for _, mdf := range g.mdFiles {
@@ -998,9 +1246,10 @@ func (pdc *processDirContext) validateStepAndRefDirs() error {
 		for _, d := range mdf.directives {
 			switch d := d.(type) {
 			case *stepDirective:
-				_, found := g.Steps[d.name]
+				_, found := g.stepsByName[mdf.lang][d.name]
 				if !found {
 					errs.Addf("%v:%v: unknown step %q referened", pdc.relpath(mdf.path), d.Pos(), d.name)
+					continue
 				}
 				stepDirectivesToCheck = append(stepDirectivesToCheck, d)
 			case *refDirective:
@@ -1019,6 +1268,9 @@ func (pdc *processDirContext) validateStepAndRefDirs() error {
 					continue
 				}
 				d.val = v
+			case *outrefDirective:
+				// Checked in validateOutRefDirs once the out package is
+				// available
 			default:
 				panic(fmt.Errorf("don't yet know how to handle %T type", d))
 			}
@@ -1038,7 +1290,7 @@ func (pdc *processDirContext) validateStepAndRefDirs() error {
 		//
 		// Notice below that we skipped
 		badOrder := false
-		stepsToCheck := g.steps
+		stepsToCheck := g.steps[mdf.lang]
 	stepDirectives:
 		for _, stepDir := range stepDirectivesToCheck {
 			if len(stepsToCheck) == 0 {
@@ -1083,26 +1335,151 @@ func (pdc *processDirContext) validateStepAndRefDirs() error {
 	return errs.Err()
 }
 
-type errList []error
-
-func (l *errList) Add(err error) {
-	*l = append(*l, err)
-}
-
-func (l *errList) Addf(format string, args ...interface{}) {
-	l.Add(fmt.Errorf(format, args...))
-}
-
-func (l errList) Err() error {
-	if len(l) == 0 {
+// validateOutRefDirs ensures that out reference directives (e.g. {{ outref
+// "cmdoutput" }}) in the guide's markdown files resolve to values in the
+// fully loaded out CUE package, and that those values are of a kind we can
+// render. An outref directive is resolved for each scenario, against the run
+// that applies to the language of the markdown file: the Defs of the run's
+// output take precedence over the top-level Defs of the out package. In -raw
+// mode the out package is never written, hence outref directives are not
+// resolved.
+func (pdc *processDirContext) validateOutRefDirs() error {
+	g := pdc.guide
+	if pdc.fMode == types.ModeRaw {
 		return nil
 	}
-	return l
-}
-
-// Error is implemented so that errList implements error
-func (l errList) Error() string {
-	if len(l) == 0 {
+	type mdOutref struct {
+		mdf *mdFile
+		d   *outrefDirective
+	}
+	var outrefs []mdOutref
+	for i := range g.mdFiles {
+		mdf := &g.mdFiles[i]
+		for _, d := range mdf.directives {
+			if d, ok := d.(*outrefDirective); ok {
+				outrefs = append(outrefs, mdOutref{mdf: mdf, d: d})
+			}
+		}
+	}
+	if len(outrefs) == 0 {
+		return nil
+	}
+	// In the case of a guide with no steps, or a cache hit, we will not
+	// necessarily have loaded the full out package
+	if !g.outVal.Exists() {
+		pdc.loadOutput(true)
+	}
+
+	pdc.cueLock.Lock()
+	defer pdc.cueLock.Unlock()
+
+	// A guide without steps has no runs, in which case outref directives
+	// are resolved once, against the top-level Defs
+	scenarios := []string{""}
+	if len(g.runs) > 0 {
+		scenarios = nil
+		for _, s := range g.Scenarios {
+			scenarios = append(scenarios, s.Name)
+		}
+	}
+
+	var errs errList
+	for _, o := range outrefs {
+		d := o.d
+		path := pdc.relpath(o.mdf.path)
+		d.vals = make(map[string]cue.Value)
+		for _, scenario := range scenarios {
+			lang := o.mdf.lang
+			if r := g.langRun(scenario, lang); r != nil {
+				lang = r.lang
+			}
+			v := pdc.lookupOutRef(scenario, lang, d.path)
+			if err := v.Err(); err != nil {
+				errs.Addf("%v:%v: failed to evaluate {%v}: %v", path, d.Pos(), d.String(), err)
+				break
+			}
+			if _, err := directiveValueString(v); err != nil {
+				errs.Addf("%v:%v: value resulting from {%v} %v", path, d.Pos(), d.String(), err)
+				break
+			}
+			d.vals[scenario] = v
+		}
+	}
+	return errs.Err()
+}
+
+// lookupOutRef looks up p in the Defs of the run for scenario and lang,
+// falling back to the top-level Defs of the out package
+func (pdc *processDirContext) lookupOutRef(scenario string, lang types.LangCode, p cue.Path) cue.Value {
+	g := pdc.guide
+	if scenario != "" {
+		sels := []cue.Selector{cue.Str("Outputs"), cue.Str(scenario), cue.Str(string(lang)), cue.Str("Defs")}
+		sels = append(sels, p.Selectors()...)
+		if v := g.outVal.LookupPath(cue.MakePath(sels...)); v.Exists() {
+			return v
+		}
+	}
+	sels := []cue.Selector{cue.Str("Defs")}
+	sels = append(sels, p.Selectors()...)
+	return g.outVal.LookupPath(cue.MakePath(sels...))
+}
+
+// directiveValueString returns the string value that should be rendered in
+// place of a directive that resolves to v. Strings and numbers are rendered
+// as is, lists of strings and numbers are rendered one element per line.
+func directiveValueString(v cue.Value) (string, error) {
+	switch k := v.Kind(); k {
+	case cue.StringKind:
+		return v.String()
+	case cue.IntKind, cue.FloatKind, cue.NumberKind:
+		b, err := format.Node(v.Syntax())
+		if err != nil {
+			return "", fmt.Errorf("failed to format number: %v", err)
+		}
+		return string(b), nil
+	case cue.ListKind:
+		var elems []string
+		iter, err := v.List()
+		if err != nil {
+			return "", err
+		}
+		for i := 0; iter.Next(); i++ {
+			ev := iter.Value()
+			if ev.Kind() == cue.ListKind {
+				return "", fmt.Errorf("is a list containing a list at index %v", i)
+			}
+			s, err := directiveValueString(ev)
+			if err != nil {
+				return "", fmt.Errorf("is a list whose element at index %v %v", i, err)
+			}
+			elems = append(elems, s)
+		}
+		return strings.Join(elems, "\n"), nil
+	default:
+		return "", fmt.Errorf("is of unsupported kind %v", k)
+	}
+}
+
+type errList []error
+
+func (l *errList) Add(err error) {
+	*l = append(*l, err)
+}
+
+func (l *errList) Addf(format string, args ...interface{}) {
+	l.Add(fmt.Errorf(format, args...))
+}
+
+func (l errList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// Error is implemented so that errList implements error
+func (l errList) Error() string {
+	if len(l) == 0 {
 		return "nil"
 	}
 	var buf bytes.Buffer
@@ -1144,72 +1521,66 @@ func (pdc *processDirContext) writeOutPackage(g *guide) {
 	check(err, "failed to write output to %v: %v", outFilePath, err)
 }
 
-func (pdc *processDirContext) runBashFile(g *guide) {
-	// Now run the pre-step if there is one
-	var toWrite string
-	for _, ps := range g.Presteps {
-		// TODO: run the presteps concurrently, but add their args in order
-		// last prestep's args last etc
-
-		var jsonBody []byte
-
-		// At this stage we know we have a valid endpoint (because we previously
-		// checked it via a get-version=1 request)
-		conf := pdc.config[ps.Package]
-		if conf.Endpoint.Scheme == "file" {
-			if ps.Args != nil {
-				raise("prestep %v (path %v) provides arguments [%v]: but prestep is configured with a file endpoint", ps.Package, ps.Path, pretty.Sprint(ps.Args))
+func (pdc *processDirContext) runBashFile(r *guideRun) {
+	g := pdc.guide
+	// Errors raised in the course of running the script can include the
+	// values of variables, be that in the output of the script or the
+	// environment of a container. Hence we redact any secret values.
+	defer func() {
+		if rec := recover(); rec != nil {
+			if ke, ok := rec.(util.KnownErr); ok {
+				rec = util.KnownErr{Err: fmt.Errorf("%s", r.redact(ke.Err.Error()))}
 			}
-			// Notice this path takes no account of the -docker flag
-			var err error
-			path := conf.Endpoint.Path
-			jsonBody, err = os.ReadFile(path)
-			check(err, "failed to read file endpoint %v (file %v): %v", conf.Endpoint, path, err)
-		} else {
-			u := *conf.Endpoint
-			u.Path = path.Join(u.Path, ps.Path)
-			jsonBody = pdc.doRequest("POST", u.String(), conf, ps.Args)
+			panic(rec)
 		}
-
-		// TODO: unmarshal jsonBody into a cue.Value, validate against a schema
-		// for valid prestep results then decode via gocodec into out (below)
-
-		var out struct {
-			Vars []string
+	}()
+	// Now run the presteps, if there are any. The requests are made
+	// concurrently, but the variables that result are added in the order in
+	// which the presteps are declared, i.e. the last prestep's variables
+	// last.
+	jsonBodies := make([][]byte, len(r.Presteps))
+	panics := make([]interface{}, len(r.Presteps))
+	var prestepsWg sync.WaitGroup
+	for i, ps := range r.Presteps {
+		i, ps := i, ps
+		prestepsWg.Add(1)
+		go func() {
+			defer func() {
+				panics[i] = recover()
+				prestepsWg.Done()
+			}()
+			jsonBodies[i] = pdc.runPrestep(ps)
+		}()
+	}
+	prestepsWg.Wait()
+	for _, p := range panics {
+		if p != nil {
+			// Pass on the panic of the first prestep (in declaration
+			// order) to fail
+			panic(p)
 		}
-		err := json.Unmarshal(jsonBody, &out)
-		check(err, "failed to unmarshal output from prestep %v: %v\n%s", ps.Package, err, jsonBody)
+	}
+	// varPrestep maps a variable name to the prestep that provided it
+	varPrestep := make(map[string]*guidePrestep)
+	for i, ps := range r.Presteps {
+		out := pdc.decodePrestepOut(ps, jsonBodies[i])
 		for _, v := range out.Vars {
 			parts := strings.SplitN(v, "=", 2)
-			if len(parts) != 2 {
-				raise("bad env var received from prestep: %q", v)
+			if other, ok := varPrestep[parts[0]]; ok {
+				raise("prestep %v (path %v) provided variable %v, which was also provided by prestep %v (path %v)", ps.Package, ps.Path, parts[0], other.Package, other.Path)
 			}
-			g.vars = append(g.vars, v)
-			g.varMap[parts[0]] = parts[1]
+			varPrestep[parts[0]] = ps
+			r.vars = append(r.vars, v)
+			r.varMap[parts[0]] = parts[1]
 			ps.Variables = append(ps.Variables, parts[0])
 		}
+		for _, name := range out.Secrets {
+			if varPrestep[name] != ps {
+				raise("prestep %v (path %v) declared variable %v as secret, but did not provide it", ps.Package, ps.Path, name)
+			}
+			r.secrets[name] = true
+		}
 	}
-	// If we have any vars we need to first perform an expansion of any
-	// templates instances {{.ENV}} that appear in the bashScript, and then
-	// append the result of that substitution. Note this substitution applies
-	// to both the commands AND the uploads
-	bashScript := g.bashScript
-	if len(g.vars) > 0 {
-		t := template.New("pre-substitution bashScript")
-		t.Delims(g.Delims[0], g.Delims[1])
-		t.Option("missingkey=error")
-		_, err := t.Parse(bashScript)
-		check(err, "failed to parse pre-substitution bashScript: %v", err)
-		var b bytes.Buffer
-		err = t.Execute(&b, g.varMap)
-		check(err, "failed to execute pre-substitution bashScript template: %v", err)
-		bashScript = b.String()
-	}
-	pdc.debugf("script:\n%s", bashScript)
-
-	// Concatenate the bash script
-	toWrite += bashScript
-
 	// Create a temp directory for our "workings". Note, this directory will
 	// not be world-readable by default. So when it comes to the directory we
 	// wil mount inside the docker container that will run the script, we
@@ -1219,115 +1590,204 @@ func (pdc *processDirContext) runBashFile(g *guide) {
 	check(err, "failed to create workings directory for guide %v: %v", g.dir, err)
 	defer os.RemoveAll(td)
 
+	// The scripts directory is mounted in the container for every terminal.
+	// It contains the script for each terminal, as well as the directory
+	// used to synchronise the handover between terminals (see buildBashFile)
 	scriptsDir := filepath.Join(td, "scripts")
 	err = os.Mkdir(scriptsDir, 0777)
 	check(err, "failed to create scripts directory %v: %v", scriptsDir, err)
-	scriptsFile := filepath.Join(scriptsDir, "script.sh")
-	err = os.WriteFile(scriptsFile, []byte(toWrite), 0777)
-	check(err, "failed to write temporary script to %v: %v", scriptsFile, err)
+	syncDir := filepath.Join(scriptsDir, "sync")
+	err = os.Mkdir(syncDir, 0777)
+	check(err, "failed to create sync directory %v: %v", syncDir, err)
 
 	// Explicitly change the permissions for the scripts directory and the
 	// script itself so that when mounted within the docker container they are
 	// runnable by anyone. This is necessary because the bind mount used adopts
 	// the same owner and permissions as the host. Therefore, to be runnable
 	// by any user, including the user who ends up running the script as defined
-	// by the image we are using, we need to be liberal.
+	// by the image we are using, we need to be liberal. The same applies to
+	// the sync directory, which needs to be writable by anyone.
 	err = os.Chmod(scriptsDir, 0777)
 	check(err, "failed to change permissions of %v: %v", scriptsDir, err)
-	err = os.Chmod(scriptsFile, 0777)
-	check(err, "failed to change permissions of %v: %v", scriptsFile, err)
+	err = os.Chmod(syncDir, 0777)
+	check(err, "failed to change permissions of %v: %v", syncDir, err)
+	checkpointDir := filepath.Join(scriptsDir, "checkpoint")
+	if len(r.checkpoints) > 0 {
+		err = os.Mkdir(checkpointDir, 0777)
+		check(err, "failed to create checkpoint directory %v: %v", checkpointDir, err)
+		err = os.Chmod(checkpointDir, 0777)
+		check(err, "failed to change permissions of %v: %v", checkpointDir, err)
+	}
+
+	for i, term := range g.Terminals {
+		// If we have any vars we need to first perform an expansion of any
+		// templates instances {{.ENV}} that appear in the bashScript, and then
+		// append the result of that substitution. Note this substitution applies
+		// to both the commands AND the uploads
+		bashScript := r.bashScripts[term.Name]
+		if len(r.vars) > 0 {
+			t := template.New("pre-substitution bashScript")
+			t.Delims(g.Delims[0], g.Delims[1])
+			t.Option("missingkey=error")
+			_, err := t.Parse(bashScript)
+			check(err, "failed to parse pre-substitution bashScript: %v", err)
+			var b bytes.Buffer
+			err = t.Execute(&b, r.varMap)
+			check(err, "failed to execute pre-substitution bashScript template: %v", err)
+			bashScript = b.String()
+		}
+		if len(g.Terminals) > 1 {
+			pdc.debugf("script for terminal %v:\n%s", term.Name, r.redact(bashScript))
+		} else {
+			pdc.debugf("script:\n%s", r.redact(bashScript))
+		}
 
-	// Whilst we know we have a single terminal, we can use the g.Image() hack
-	// of finding the image for that single terminal. We we support multiple
-	// terminals we will need to move away from that hack
-	image := g.Image()
-	if *pdc.fImageOverride != "" {
-		image = *pdc.fImageOverride
+		scriptsFile := filepath.Join(scriptsDir, terminalScriptName(i))
+		err = os.WriteFile(scriptsFile, []byte(bashScript), 0777)
+		check(err, "failed to write temporary script to %v: %v", scriptsFile, err)
+		err = os.Chmod(scriptsFile, 0777)
+		check(err, "failed to change permissions of %v: %v", scriptsFile, err)
+	}
+
+	// The terminals of a guide with multiple terminals are joined to a
+	// network created for this run, on which each terminal can reach the
+	// others by their names. For example, a client in one terminal can make
+	// requests to a server running in another.
+	networks := g.Networks
+	var termNetwork string
+	if len(g.Terminals) > 1 {
+		termNetwork = filepath.Base(td)
+		err = pdc.executor.CreateNetwork(termNetwork)
+		check(err, "failed to create network %v for the terminals of guide %v: %v", termNetwork, g.dir, err)
+		defer func() {
+			// Remove the network regardless, but do not let a failure to
+			// do so mask the failure of the run
+			rec := recover()
+			err := pdc.executor.RemoveNetwork(termNetwork)
+			if rec != nil {
+				panic(rec)
+			}
+			check(err, "failed to remove network %v: %v", termNetwork, err)
+		}()
+		networks = append(append([]string{}, g.Networks...), termNetwork)
 	}
 
-	// Whilst we know we have a single terminal, we know we can also safely
-	// address the single terminal's name for the purposes of checking our
-	// -runargs flag values
-	term := g.Terminals[0]
-	var termRunArgs []string
-	for _, a := range pdc.fRunArgs {
-		var err error
-		p := term.Name + "="
-		if !strings.HasPrefix(a, p) {
-			raise("bad argument passed to -runargs, does not correspond to terminal: %q", a)
+	runArgs := pdc.runArgs()
+	runs := make([]*terminalRun, len(g.Terminals))
+	for i, term := range g.Terminals {
+		// resumeFromCheckpoint has already ensured a checkpoint image exists
+		image := pdc.runImage(r, term)
+		if r.checkpoint != nil {
+			image = r.checkpoint.Image
+		} else {
+			pdc.ensureImage(image)
 		}
-		v := strings.TrimPrefix(a, p)
-		termRunArgs, err = split(v)
-		check(err, "failed to split -runargs in words: %v; value was %q", err, v)
-	}
 
-	imageCheck := exec.Command("docker", "inspect", image)
-	out, err := imageCheck.CombinedOutput()
-	if err != nil {
-		if *pdc.fPullImage == pullImageMissing {
-			pdc.debugf("failed to find docker image %v (%v); will attempt pull\n", image, err)
-			pull := exec.Command("docker", "pull", image)
-			out, err = pull.CombinedOutput()
-			check(err, "failed to find docker image %v; also failed to pull it: %v\n%s", image, err, out)
-		} else {
-			raise("failed to find docker image %v (%v); either pull this image manually or use -pull=missing", image, err)
+		var env []string
+		env = append(env, r.vars...)
+		env = append(env, g.Env...)
+		conf := containerConfig{
+			Image:      image,
+			Cmd:        []string{path.Join("/scripts", terminalScriptName(i))},
+			Env:        env,
+			Mounts:     []mount{{Source: scriptsDir, Target: "/scripts"}},
+			TTY:        true, // otherwise stderr is not line buffered
+			AutoRemove: true,
+			Args:       runArgs[term.Name],
+		}
+		if termNetwork != "" {
+			conf.Hostname = term.Name
+		}
+		cmd := pdc.newContainerRunner(networks, conf)
+		if termNetwork != "" {
+			cmd.Aliases = map[string][]string{termNetwork: {term.Name}}
+		}
+		runs[i] = &terminalRun{
+			term:   term,
+			cmd:    cmd,
+			redact: r.redact,
 		}
 	}
 
-	cmd := pdc.newDockerRunner(g.Networks,
-		"--rm",
-		"-t", // otherwise stderr is not line buffered
-		"-v", fmt.Sprintf("%v:/scripts", scriptsDir),
-	)
-	cmd.Args = append(cmd.Args, termRunArgs...)
-	for _, v := range g.vars {
-		cmd.Args = append(cmd.Args, "-e", v)
+	// Time the sections of each terminal's script that are subject to a
+	// timeout. When a timeout expires, we kill the containers for all
+	// terminals.
+	var timeoutOnce sync.Once
+	var timedOut *timedSection
+	var timedOutOutput string
+	for _, tr := range runs {
+		tr.timer = newSectionTimer(scriptsDir, r.timed[tr.term.Name], func(s *timedSection, output string) {
+			timeoutOnce.Do(func() {
+				timedOut, timedOutOutput = s, output
+				for _, o := range runs {
+					o.cmd.Kill()
+				}
+			})
+		})
 	}
-	for _, v := range g.Env {
-		cmd.Args = append(cmd.Args, "-e", v)
+
+	// Checkpoints are only taken for a guide with a single terminal
+	var cp *checkpointer
+	if len(r.checkpoints) > 0 {
+		cp = pdc.newCheckpointer(checkpointDir, runs[0].cmd, r.checkpoints)
+		go cp.run()
 	}
-	cmd.Args = append(cmd.Args, image, "/scripts/script.sh")
 
-	if os.Getenv("PREGUIDE_PROGRESS") == "true" {
-		var outbuf bytes.Buffer
-		pipeRead, pipeWrite := io.Pipe()
-		cmd.Stdout = io.MultiWriter(&outbuf, pipeWrite)
-		cmd.Stderr = cmd.Stdout
-		pipeDone := make(chan error)
+	// Run the script for each terminal concurrently. The scripts themselves
+	// take care of waiting on each other at the handover between terminals.
+	// A failure in one terminal means that the other terminals will never
+	// see the handover they are waiting on, so we kill them.
+	var wg sync.WaitGroup
+	var failOnce sync.Once
+	var failed *terminalRun
+	for _, tr := range runs {
+		tr := tr
+		wg.Add(1)
 		go func() {
-			s := bufio.NewScanner(pipeRead)
-			for s.Scan() {
-				fmt.Printf("%v: %v\n", pdc.relpath(g.dir), s.Text())
+			defer wg.Done()
+			prefix := pdc.relpath(g.dir)
+			if len(g.Terminals) > 1 {
+				prefix += ": " + tr.term.Name
 			}
-			if err := s.Err(); err != nil && err != io.EOF {
-				pipeDone <- err
+			tr.run(prefix)
+			if tr.err == nil {
+				return
 			}
-			close(pipeDone)
+			failOnce.Do(func() {
+				failed = tr
+				for _, o := range runs {
+					if o != tr {
+						o.cmd.Kill()
+					}
+				}
+			})
 		}()
-		err = cmd.Run()
-		check(err, "failed to run [%v]: %v\n%s", strings.Join(cmd.Args, " "), err, out)
-		err = pipeWrite.Close()
-		check(err, "failed to close write pipe for [%v]: %v", strings.Join(cmd.Args, " "), cmd)
-		err = <-pipeDone
-		check(err, "failed to write output from [%v]: %v", strings.Join(cmd.Args, " "), err)
-		out = outbuf.Bytes()
-	} else {
-		out, err = cmd.CombinedOutput()
-		check(err, "failed to run [%v]: %v\n%s", strings.Join(cmd.Args, " "), err, out)
+	}
+	wg.Wait()
+	for _, tr := range runs {
+		tr.timer.stop()
+	}
+	if cp != nil {
+		cp.stop()
+	}
+	if timedOut != nil {
+		raise("step %v: statement %d: timed out after %v %v; output so far:\n%s", timedOut.step, timedOut.stmt, timedOut.timeout, timedOut.what, timedOutOutput)
+	}
+	if failed != nil {
+		raise("failed to run [%v]: %v\n%s", failed.cmd, failed.err, failed.out)
 	}
 
-	pdc.debugf("script output:\n%s", out)
-
-	walk := out
-	slurp := func(end []byte) (res string) {
-		endI := bytes.Index(walk, end)
-		if endI == -1 {
-			raise("failed to find %q before end of output:\n%q\nOutput was: %q\n", end, walk, out)
+	outputs := make(map[string]*scriptOutput)
+	for _, tr := range runs {
+		if len(g.Terminals) > 1 {
+			pdc.debugf("script output for terminal %v:\n%s", tr.term.Name, r.redact(string(tr.out)))
+		} else {
+			pdc.debugf("script output:\n%s", r.redact(string(tr.out)))
+		}
+		outputs[tr.term.Name] = &scriptOutput{
+			out:  tr.out,
+			walk: tr.out,
 		}
-		res, walk = string(walk[:endI]), walk[endI+len(end):]
-		// Because we are running in -t mode, replace all \r\n with \n
-		res = strings.ReplaceAll(res, "\r\n", "\n")
-		return res
 	}
 
 	// As we go through getting the output, continue to build up a list of
@@ -1335,47 +1795,86 @@ func (pdc *processDirContext) runBashFile(g *guide) {
 	// to happen in a second pass, because some of the commands define
 	// what will be random output.
 	//
-	// First add the variables that are the result of the prestep.
+	// First add the variables that are the result of the prestep. Secret
+	// values are sanitised even in raw mode.
 	var sanVals [][2]string
-	if pdc.fMode != types.ModeRaw {
-		for name, val := range g.varMap {
-			repl := g.Delims[0] + "." + name + g.Delims[1]
+	for name, val := range r.varMap {
+		if pdc.fMode == types.ModeRaw && !r.secrets[name] {
+			continue
+		}
+		repl := g.Delims[0] + "." + name + g.Delims[1]
+		sanVals = append(sanVals, [2]string{
+			val, repl,
+		})
+	}
+	parseStmt := func(so *scriptOutput, stmt *commandStmt) {
+		var stepOutput *bytes.Buffer
+		doRandomReplace := pdc.fMode != types.ModeRaw && stmt.RandomReplace != nil
+		if doRandomReplace {
+			stepOutput = new(bytes.Buffer)
+		}
+		// TODO: tidy this up
+		fence := []byte(stmt.outputFence + "\r\n")
+		so.slurp(fence) // Ignore everything before the fence
+		stmt.Output = so.slurp(fence)
+		if doRandomReplace {
+			stepOutput.WriteString(stmt.Output)
+		}
+		exitCodeStr := so.slurp([]byte("\r\n"))
+		stmt.ExitCode, err = strconv.Atoi(exitCodeStr)
+		check(err, "failed to parse exit code from %q at position %v in output: %v\n%s", exitCodeStr, len(so.out)-len(so.walk)-len(exitCodeStr)-1, err, so.out)
+		if doRandomReplace {
+			v := stmt.Output
+			if stmt.DoNotTrim == nil || !*stmt.DoNotTrim {
+				v = trimTrailingNewline(v)
+			}
 			sanVals = append(sanVals, [2]string{
-				val, repl,
+				v, *stmt.RandomReplace,
 			})
 		}
 	}
-	for _, step := range g.steps {
+	// The output for blocking and background statements appears out of
+	// order: see buildBashFile
+	blocked := make(map[string]*commandStmt)
+	background := make(map[string][]*commandStmt)
+	for _, step := range r.steps[r.resume:] {
 		switch step := step.(type) {
 		case *commandStep:
+			so := outputs[step.terminal()]
 			for _, stmt := range step.Stmts {
-				var stepOutput *bytes.Buffer
-				doRandomReplace := pdc.fMode != types.ModeRaw && stmt.RandomReplace != nil
-				if doRandomReplace {
-					stepOutput = new(bytes.Buffer)
-				}
-				// TODO: tidy this up
-				fence := []byte(stmt.outputFence + "\r\n")
-				slurp(fence) // Ignore everything before the fence
-				stmt.Output = slurp(fence)
-				if doRandomReplace {
-					stepOutput.WriteString(stmt.Output)
-				}
-				exitCodeStr := slurp([]byte("\r\n"))
-				stmt.ExitCode, err = strconv.Atoi(exitCodeStr)
-				check(err, "failed to parse exit code from %q at position %v in output: %v\n%s", exitCodeStr, len(out)-len(walk)-len(exitCodeStr)-1, err, out)
-				if doRandomReplace {
-					v := stmt.Output
-					if stmt.DoNotTrim == nil || !*stmt.DoNotTrim {
-						v = trimTrailingNewline(v)
-					}
-					sanVals = append(sanVals, [2]string{
-						v, *stmt.RandomReplace,
-					})
+				switch {
+				case stmt.isInterrupt():
+					parseStmt(so, blocked[step.Terminal])
+					delete(blocked, step.Terminal)
+				case stmt.isBlocking():
+					blocked[step.Terminal] = stmt
+				case stmt.isBackground():
+					background[step.Terminal] = append(background[step.Terminal], stmt)
+				default:
+					parseStmt(so, stmt)
 				}
 			}
 		}
 	}
+	for _, t := range g.Terminals {
+		for _, stmt := range background[t.Name] {
+			parseStmt(outputs[t.Name], stmt)
+		}
+	}
+	// Now check the exit code of each statement that specifies an ExitCode.
+	// The steps before r.resume were not run: their output is that of the
+	// previous run, already sanitised.
+	for _, step := range r.steps[r.resume:] {
+		step, ok := step.(*commandStep)
+		if !ok {
+			continue
+		}
+		for i, stmt := range step.Stmts {
+			if stmt.exitCode != nil && !pdc.exitCodeSatisfies(*stmt.exitCode, stmt.ExitCode) {
+				raise("step %v: statement %d: exit code %d does not satisfy ExitCode %v; output was:\n%s", step.Name, i, stmt.ExitCode, *stmt.exitCode, stmt.Output)
+			}
+		}
+	}
 	// Ensure we do not have any duplicate values to be sanitised
 	// (we even error if we see the a value more than once with the
 	// same replacement)
@@ -1400,7 +1899,7 @@ func (pdc *processDirContext) runBashFile(g *guide) {
 		return len(lhs[0]) > len(rhs[0])
 	})
 	// Now sanitise everything
-	for _, step := range g.steps {
+	for _, step := range r.steps[r.resume:] {
 		switch step := step.(type) {
 		case *commandStep:
 			for _, stmt := range step.Stmts {
@@ -1426,127 +1925,598 @@ func (pdc *processDirContext) runBashFile(g *guide) {
 	}
 }
 
-// buildBashFile creates a bash file to run for the language-specific steps of
-// a guide.
-func (pdc *processDirContext) buildBashFile(g *guide) {
-	// TODO when we come to support multiple terminals this will need to be
-	// rethought. Perhaps something along the following lines:
-	//
-	// * We in effect create a special bash script per terminal. But we don't
-	// write that script and then run it in one shot, we instead use docker
-	// run -i and have bash read from stdin. This way we can control the order
-	// of events between terminals.
-	//
-	// * The stdout and stderr of the docker run process should be the same
-	// value (per os/exec) so that we get correctly interleaved stdout and
-	// stderr
-	//
-	// * The order of steps is defined by the natural source order of step
-	// names. That is to say, the first time a step declaration is encountered
-	// determines that step's position in the order of all steps
-	//
-	// * We only need to block a given terminal at the "edge" of handover
-	// between terminals
-	//
-	// * We can determine the process ID of the special bash script by echo-ing
-	// $$ at the start of the special script.
-	//
-	// * This is fine because it opens the door for us being able to supply
-	// input over stdin should this ever be necessary
-	//
-	// * Question is how to deal with blocking calls, e.g. running an http
-	// server. Support this initially by not allowing background processes or
-	// builtins (because with builtins there is no child process). Then
-	// interpreting a special kill or <Ctrl-c> command to kill the current
-	// (because there can only be one) blocked process. Then continuing to the
-	// next "block"
-	//
-	// * How to identify these blocking calls? Well, so long as we don't support
-	// background processes then the next call _must_ be a <Ctrl-c> (even if
-	// that is the last command in a script), otherwise that script cannot make
-	// progress or return. This might be sufficient an indicator for now.
-	//
-	// * As part of this we should not expect a blocking call to echo the
-	// final code fence until we kill it, and vice versa: a non-blocking call
-	// should output the code fence (so we should wait until we see it)
-	//
+// compileExitCodes compiles the ExitCode of each statement of the guide g,
+// ensuring that each is a valid CUE constraint for an exit code. Errors are
+// reported at the position of the ExitCode field. The caller must hold
+// pdc.cueLock.
+func (pdc *processDirContext) compileExitCodes(g *guide) {
+	g.exitCodes = make(map[types.ExitCode]cue.Value)
+	intVal := pdc.context.CompileString("int")
+	g.val.LookupPath(cue.ParsePath("Steps")).Walk(func(v cue.Value) bool {
+		if l, _ := v.Label(); l != "ExitCode" {
+			return true
+		}
+		var c types.ExitCode
+		var cv cue.Value
+		switch v.IncompleteKind() {
+		case cue.IntKind:
+			c = types.ExitCode(fmt.Sprint(v))
+			cv = v
+		case cue.StringKind:
+			s, err := v.String()
+			check(err, "%v: failed to evaluate ExitCode: %v", pdc.cuePos(v.Pos()), err)
+			c = types.ExitCode(s)
+			cv = pdc.context.CompileString(s)
+		default:
+			// A step or field of a step that happens to be called ExitCode
+			return true
+		}
+		err := cv.Unify(intVal).Err()
+		check(err, "%v: bad ExitCode %q: %v", pdc.cuePos(v.Pos()), c, err)
+		g.exitCodes[c] = cv
+		return false
+	}, nil)
+}
+
+// cuePos returns the position p relative to the working directory
+func (pdc *processDirContext) cuePos(p token.Pos) string {
+	return fmt.Sprintf("%v:%v:%v", pdc.relpath(p.Filename()), p.Line(), p.Column())
+}
+
+// exitCodeSatisfies reports whether the exit code code satisfies the CUE
+// constraint c
+func (pdc *processDirContext) exitCodeSatisfies(c types.ExitCode, code int) bool {
+	pdc.cueLock.Lock()
+	defer pdc.cueLock.Unlock()
+	cv, ok := pdc.guide.exitCodes[c]
+	if !ok {
+		panic(fmt.Errorf("ExitCode %q was not compiled when the guide was loaded", c))
+	}
+	v := cv.Unify(pdc.context.Encode(code))
+	return v.Validate(cue.Concrete(true)) == nil
+}
+
+// runArgs returns the -runargs flag values split into words, by terminal
+// name. It ensures that each -runargs flag value corresponds to a terminal.
+func (pdc *processDirContext) runArgs() map[string][]string {
+	g := pdc.guide
+	res := make(map[string][]string)
+	for _, a := range pdc.fRunArgs {
+		var term *preguide.Terminal
+		for _, t := range g.Terminals {
+			if strings.HasPrefix(a, t.Name+"=") {
+				term = t
+				break
+			}
+		}
+		if term == nil {
+			raise("bad argument passed to -runargs, does not correspond to terminal: %q", a)
+		}
+		v := strings.TrimPrefix(a, term.Name+"=")
+		var err error
+		res[term.Name], err = split(v)
+		check(err, "failed to split -runargs in words: %v; value was %q", err, v)
+	}
+	return res
+}
+
+// runImage returns the image used to run the script for the terminal t in
+// the run r, i.e. the image declared by the guide unless overridden by
+// -image
+func (pdc *processDirContext) runImage(r *guideRun, t *preguide.Terminal) string {
+	if *pdc.fImageOverride != "" {
+		return *pdc.fImageOverride
+	}
+	return r.image(t)
+}
+
+// imageDigest returns the digest of image, ensuring first that image is
+// available locally
+func (pdc *processDirContext) imageDigest(image string) string {
+	pdc.ensureImage(image)
+	d, err := pdc.executor.ImageDigest(image)
+	check(err, "failed to resolve digest of image %v: %v", image, err)
+	return d
+}
+
+// terminalScriptName is the name of the script file for the terminal at
+// index i in the guide's declared terminals
+func terminalScriptName(i int) string {
+	return fmt.Sprintf("terminal%v.sh", i)
+}
+
+// ensureImage checks that image is available locally, pulling it if we have
+// been asked to pull missing images
+func (pdc *processDirContext) ensureImage(image string) {
+	err := pdc.executor.ImageExists(image)
+	if err == nil {
+		return
+	}
+	if *pdc.fPullImage == pullImageMissing {
+		pdc.debugf("failed to find docker image %v (%v); will attempt pull\n", image, err)
+		err = pdc.executor.PullImage(image)
+		check(err, "failed to find docker image %v; also failed to pull it: %v", image, err)
+	} else {
+		raise("failed to find docker image %v (%v); either pull this image manually or use -pull=missing", image, err)
+	}
+}
+
+// decodePrestepOut validates the response jsonBody from the prestep ps
+// against the #PrestepOut schema, returning the decoded result
+func (pdc *processDirContext) decodePrestepOut(ps *guidePrestep, jsonBody []byte) (res preguide.PrestepOut) {
+	pdc.cueLock.Lock()
+	defer pdc.cueLock.Unlock()
+	v := pdc.context.CompileBytes(jsonBody, cue.Filename(ps.Package))
+	err := v.Err()
+	check(err, "failed to parse response from prestep %v: %v\n%s", ps.Package, err, jsonBody)
+	v = pdc.schemas.PrestepOut.Unify(v)
+	err = v.Validate(cue.Concrete(true))
+	if err != nil {
+		var errstr strings.Builder
+		errors.Print(&errstr, err, nil)
+		raise("invalid response from prestep %v: %v", ps.Package, errstr.String())
+	}
+	err = v.Decode(&res)
+	check(err, "failed to decode response from prestep %v: %v", ps.Package, err)
+	return res
+}
+
+// runPrestep makes the request for the prestep ps, returning the (JSON)
+// response body
+func (pdc *processDirContext) runPrestep(ps *guidePrestep) []byte {
+	// At this stage we know we have a valid endpoint (because we previously
+	// checked it via a get-version=1 request)
+	conf := pdc.config[ps.Package]
+	switch conf.Endpoint.Scheme {
+	case "file":
+		if ps.Args != nil {
+			raise("prestep %v (path %v) provides arguments [%v]: but prestep is configured with a file endpoint", ps.Package, ps.Path, pretty.Sprint(ps.Args))
+		}
+		// Notice this path takes no account of the -docker flag
+		path := conf.Endpoint.Path
+		jsonBody, err := os.ReadFile(path)
+		check(err, "failed to read file endpoint %v (file %v): %v", conf.Endpoint, path, err)
+		return jsonBody
+	case "exec":
+		// Like the file scheme, this path takes no account of the -docker
+		// flag
+		args, err := json.Marshal(ps.Args)
+		check(err, "failed to encode args (%v) for prestep %v: %v", pretty.Sprint(ps.Args), ps.Package, err)
+		jsonBody, err := execPrestep(conf, args, ps.Path)
+		check(err, "failed to run exec endpoint %v for prestep %v (path %v): %v", conf.Endpoint, ps.Package, ps.Path, err)
+		return jsonBody
+	}
+	u := *conf.Endpoint
+	u.Path = path.Join(u.Path, ps.Path)
+	return pdc.doRequest("POST", u.String(), conf, ps.Args)
+}
+
+// terminalRun is the running of the script for a single terminal
+type terminalRun struct {
+	term  *preguide.Terminal
+	cmd   *containerRunner
+	timer *sectionTimer
+	out   []byte
+	err   error
+
+	// redact redacts secret values from the progress output of the run
+	redact func(string) string
+}
+
+// run runs the script for the terminal, capturing the combined output, which
+// is also written to the timer for the terminal. If PREGUIDE_PROGRESS=true,
+// then each line of output is also written to os.Stdout with the supplied
+// prefix.
+func (tr *terminalRun) run(prefix string) {
+	var outbuf bytes.Buffer
+	if os.Getenv("PREGUIDE_PROGRESS") != "true" {
+		tr.cmd.Stdout = io.MultiWriter(&outbuf, tr.timer)
+		tr.cmd.Stderr = tr.cmd.Stdout
+		tr.err = tr.cmd.Run()
+		tr.out = outbuf.Bytes()
+		return
+	}
+	pipeRead, pipeWrite := io.Pipe()
+	tr.cmd.Stdout = io.MultiWriter(&outbuf, tr.timer, pipeWrite)
+	tr.cmd.Stderr = tr.cmd.Stdout
+	pipeDone := make(chan error)
+	go func() {
+		s := bufio.NewScanner(pipeRead)
+		for s.Scan() {
+			fmt.Printf("%v: %v\n", prefix, tr.redact(s.Text()))
+		}
+		if err := s.Err(); err != nil && err != io.EOF {
+			pipeDone <- err
+		}
+		close(pipeDone)
+	}()
+	tr.err = tr.cmd.Run()
+	pipeWrite.Close()
+	if err := <-pipeDone; err != nil && tr.err == nil {
+		tr.err = fmt.Errorf("failed to write output: %v", err)
+	}
+	tr.out = outbuf.Bytes()
+}
 
+// scriptOutput is the output that results from running the script for a
+// terminal. walk is the remaining output, consumed as we walk through the
+// steps for that terminal.
+type scriptOutput struct {
+	out  []byte
+	walk []byte
+}
+
+// slurp returns the output up to end, advancing beyond end
+func (so *scriptOutput) slurp(end []byte) (res string) {
+	endI := bytes.Index(so.walk, end)
+	if endI == -1 {
+		raise("failed to find %q before end of output:\n%q\nOutput was: %q\n", end, so.walk, so.out)
+	}
+	res, so.walk = string(so.walk[:endI]), so.walk[endI+len(end):]
+	// Because we are running in -t mode, replace all \r\n with \n
+	res = strings.ReplaceAll(res, "\r\n", "\n")
+	return res
+}
+
+// buildBashFile creates a bash file per terminal to run for the
+// language-specific steps of a guide.
+//
+// The order of steps is defined by the natural source order of step names.
+// That is to say, the first time a step declaration is encountered determines
+// that step's position in the order of all steps. Each terminal runs in its
+// own container, and the scripts for all terminals are run concurrently. The
+// ordering between terminals is controlled by the scripts themselves: a
+// terminal only needs to block at the "edge" of a handover between
+// terminals. At such an edge, the terminal handing over creates a file in
+// the (shared) sync directory; the terminal taking over waits for that file
+// to exist before continuing. Every terminal waits for the last step of the
+// guide to complete before exiting, so that processes started in one
+// terminal remain available for the steps in other terminals.
+//
+// A guide with a single terminal therefore results in a single script with no
+// synchronisation.
+func (pdc *processDirContext) buildBashFile(r *guideRun) {
+	g := pdc.guide
 	// exitCodeVar is the name of the "temporary" variable used to capture
 	// the exit code from a command. Named something suitably esoteric to
 	// avoid user-declared variables
 	const exitCodeVar = "____x"
 
-	var sb strings.Builder
+	scripts := make(map[string]*strings.Builder)
+	var sb *strings.Builder
 	pf := func(format string, args ...interface{}) {
-		fmt.Fprintf(&sb, format, args...)
+		fmt.Fprintf(sb, format, args...)
+	}
+
+	// Blocking and background statements are run in the background with
+	// their output captured to a file in the scripts directory (the name of
+	// which is the statement's output fence). The output for such a statement
+	// is only written once its process has been interrupted: for a blocking
+	// statement that is at the following interrupt statement; for a
+	// background statement that is at the end of the script for the
+	// terminal. See runBashFile for the corresponding parsing of output.
+	//
+	// Job control is enabled only to start the process, in order that the
+	// process is started in its own process group with the default handling
+	// of SIGINT, just as it would be in an interactive shell.
+	type longRunning struct {
+		terminal string
+		step     string
+		index    int
+		stmt     *commandStmt
+	}
+	blocked := make(map[string]*longRunning)
+	background := make(map[string][]*longRunning)
+	longRunningFile := func(stmt *commandStmt) string {
+		return fmt.Sprintf("\"$%v/%v\"", scriptsDirVar, stmt.outputFence)
+	}
+	longRunningPid := func(stmt *commandStmt) string {
+		return "____p" + stmt.outputFence
+	}
+	// stdin returns the redirection and here-document that provide the
+	// input for stmt, if any
+	stdin := func(stmt *commandStmt) (redirect, heredoc string) {
+		if stmt.Stdin == nil {
+			return "", ""
+		}
+		fence := getFence()
+		return fmt.Sprintf(" <<'%v'", fence), fmt.Sprintf("%v%v\n", withTrailingNewline(*stmt.Stdin), fence)
+	}
+	// Statements are subject to a timeout, as is waiting for the output of a
+	// long-running statement to match WaitFor, and waiting for such a
+	// statement to exit once interrupted. The timeout for a section of the
+	// script is enforced as the script runs: see runBashFile.
+	r.timed = make(map[string][]*timedSection)
+	timed := func(term, step string, index int, stmt *commandStmt, what string) (fence string) {
+		fence = stmt.outputFence
+		var file string
+		if stmt.isBlocking() || stmt.isBackground() {
+			fence = getFence()
+			file = stmt.outputFence
+		}
+		var timeout time.Duration
+		switch {
+		case stmt.timeout != nil:
+			timeout = *stmt.timeout
+		case g.timeout != nil:
+			timeout = *g.timeout
+		default:
+			timeout = *pdc.fTimeout
+		}
+		if timeout > 0 {
+			r.timed[term] = append(r.timed[term], &timedSection{
+				step:    step,
+				stmt:    index,
+				what:    what,
+				fence:   fence,
+				timeout: timeout,
+				file:    file,
+			})
+		}
+		return fence
+	}
+	startLongRunning := func(lr *longRunning) {
+		stmt := lr.stmt
+		redirect, heredoc := stdin(stmt)
+		pf("set -m\n")
+		pf("{ %v\n} > %v 2>&1%v &\n", stmt.CmdStr, longRunningFile(stmt), redirect)
+		pf("%v", heredoc)
+		pf("%v=$!\n", longRunningPid(stmt))
+		pf("set +m\n")
+		if stmt.waitFor != nil {
+			waitFor, err := syntax.Quote(*stmt.waitFor, syntax.LangBash)
+			check(err, "failed to quote WaitFor value %q: %v", *stmt.waitFor, err)
+			fence := timed(lr.terminal, lr.step, lr.index, stmt, "waiting for output to match WaitFor")
+			pf("echo %v\n", fence)
+			pf("until grep -q -E %v %v || ! kill -0 $%v 2>/dev/null; do sleep 0.1; done\n", waitFor, longRunningFile(stmt), longRunningPid(stmt))
+			pf("echo %v\n", fence)
+		}
+	}
+	stopLongRunning := func(lr *longRunning) {
+		stmt := lr.stmt
+		fence := timed(lr.terminal, lr.step, lr.index, stmt, "waiting for the statement to exit after being interrupted")
+		pf("echo %v\n", fence)
+		pf("kill -INT -- -$%v 2>/dev/null\n", longRunningPid(stmt))
+		pf("wait $%v\n", longRunningPid(stmt))
+		pf("%s=$?\n", exitCodeVar)
+		pf("echo %v\n", fence)
+		pf("echo %v\n", stmt.outputFence)
+		pf("cat %v\n", longRunningFile(stmt))
+		pf("echo %v\n", stmt.outputFence)
+		pf("echo $%s\n", exitCodeVar)
 	}
 	h := sha256.New()
 	var out io.Writer = h
-	if *pdc.fDebugCache {
+	// The script for a run that resumes from a checkpoint is a rebuild, the
+	// hash inputs of which have already been written to any debug file
+	if *pdc.fDebugCache && r.checkpoint == nil {
 		now := time.Now().UTC()
-		debugFileName := fmt.Sprintf("%v_%v_%v.txt", g.name, now.Format("20060102_150405"), now.Nanosecond())
+		debugFileName := fmt.Sprintf("%v_%v_%v_%v.txt", g.name, r.fileSuffix(), now.Format("20060102_150405"), now.Nanosecond())
 		debugFile, err := os.OpenFile(debugFileName, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
 		check(err, "failed to create cache debug file %v: %v", debugFileName, err)
 		out = io.MultiWriter(out, debugFile)
 	}
-	hf := func(format string, args ...interface{}) {
-		fmt.Fprintf(out, format, args...)
+	// hf writes an input to the hash, recording it in r.HashInputs under key
+	// so that the inputs that changed between runs can be explained
+	r.HashInputs = nil
+	hf := func(key, format string, args ...interface{}) {
+		v := fmt.Sprintf(format, args...)
+		fmt.Fprint(out, v)
+		r.HashInputs = append(r.HashInputs, &hashInput{
+			Key:   key,
+			Value: strings.TrimSpace(v),
+		})
 	}
 	// Write the module info for github.com/play-with-go/preguide
-	hf("preguide: %#v\n", pdc.versionString)
+	hf("preguide", "preguide: %#v\n", pdc.versionString)
 	// We write the Presteps information to the hash, and only run the pre-step
 	// if we have a cache miss and come to run the bash file. Note that
 	// this _includes_ the buildID (hence the use of pretty.Sprint rather
 	// than JSON), whereas in the log we use JSON to _not_ include the
 	// buildID
-	hf("prestep: %s\n", mustJSONMarshalIndent(g.Presteps))
-	// We write the docker image to the hash, because if the user want to ensure
-	// reproducibility they should specify the full digest.
-	hf("image: %v\n", g.Image())
-	pf("#!/usr/bin/env -S bash -l\n")
-	pf("export TERM=dumb\n")
-	pf("export NO_COLOR=true\n")
-	for _, step := range g.steps {
+	hf("presteps", "prestep: %s\n", mustJSONMarshalIndent(r.Presteps))
+	// Scripts run on the host give different results to those run in a
+	// container, so we ensure the two never share a cache entry
+	if *pdc.fExecutor == executorLocal {
+		hf("executor", "executor: %v\n", executorLocal)
+	}
+	// The environment and networks of the containers in which the scripts
+	// run can change the output of the guide. A pass-through Env entry, i.e.
+	// NAME rather than NAME=value, is deliberately written by name only: its
+	// value comes from the host, is typically a credential, and would
+	// otherwise be recorded in the out package via HashInputs.
+	if len(g.Env) > 0 {
+		hf("env", "env: %s\n", mustJSONMarshalIndent(g.Env))
+	}
+	if len(g.Networks) > 0 {
+		hf("networks", "networks: %s\n", mustJSONMarshalIndent(g.Networks))
+	}
+	// We write the docker image declared for each terminal to the hash, as
+	// well as the image actually used where that differs (in case of -image)
+	// and, unless -image-digest=false, its digest. The digest means that a
+	// tag that has moved to a different image results in a cache miss.
+	// -runargs can change the container in which the script runs, so we also
+	// write any for each terminal.
+	//
+	// The name of the terminal of a step is only written to the hash for a
+	// guide with multiple terminals, in order that the hash of a guide with
+	// a single terminal is unchanged from before multiple terminals were
+	// supported.
+	multiTerm := len(g.Terminals) > 1
+	stepHashName := func(s step) string {
+		if multiTerm {
+			return fmt.Sprintf("step: %q, terminal: %q", s.name(), s.terminal())
+		}
+		return fmt.Sprintf("step: %q", s.name())
+	}
+	runArgs := pdc.runArgs()
+	for _, t := range g.Terminals {
+		if multiTerm {
+			hf(fmt.Sprintf("terminal %q", t.Name), "terminal: %v, image: %v\n", t.Name, r.image(t))
+		} else {
+			hf(fmt.Sprintf("terminal %q", t.Name), "image: %v\n", r.image(t))
+		}
+		image := pdc.runImage(r, t)
+		var d string
+		if *pdc.fImageDigest {
+			d = pdc.imageDigest(image)
+		}
+		switch {
+		case d != "":
+			hf(fmt.Sprintf("terminal %q run image", t.Name), "  run image: %v, digest: %v\n", image, d)
+		case image != r.image(t):
+			hf(fmt.Sprintf("terminal %q run image", t.Name), "  run image: %v\n", image)
+		}
+		if args := runArgs[t.Name]; len(args) > 0 {
+			hf(fmt.Sprintf("terminal %q runargs", t.Name), "  runargs: %s\n", mustJSONMarshalIndent(args))
+		}
+		sb = new(strings.Builder)
+		scripts[t.Name] = sb
+		pf("#!/usr/bin/env -S bash -l\n")
+		pf("export TERM=dumb\n")
+		pf("export NO_COLOR=true\n")
+		pf("%v=\"$(dirname \"$0\")\"\n", scriptsDirVar)
+		// Restore the working directory and environment of the script at
+		// the checkpoint from which the run resumes
+		if c := r.checkpoint; c != nil {
+			quote := func(v string) string {
+				q, err := syntax.Quote(v, syntax.LangBash)
+				check(err, "failed to quote %q from checkpoint %v: %v", v, c.Image, err)
+				return q
+			}
+			pf("cd %v\n", quote(c.Dir))
+			for _, e := range c.Env {
+				pf("export %v\n", quote(e))
+			}
+		}
+	}
+	// The steps before r.resume are written to the hash, but are not run.
+	// After each step that can be checkpointed, and for which there is not
+	// already a checkpoint, the script signals that it has reached the
+	// checkpoint and waits for it to be taken: see checkpointer.
+	checkpointable := pdc.checkpointable(r)
+	r.checkpoints = nil
+	// handover is the number of handovers between terminals so far
+	var handover int
+	var lastTerm string
+	for si, step := range r.steps {
+		resumed := si < r.resume
+		if term := step.terminal(); term != lastTerm {
+			if lastTerm != "" {
+				handover++
+				pf("touch %v\n", syncFile(handover))
+			}
+			sb = scripts[term]
+			if lastTerm != "" {
+				pf("%v\n", waitSyncFile(handover))
+			}
+			lastTerm = term
+		}
 		switch step := step.(type) {
 		case *commandStep:
 			for i, stmt := range step.Stmts {
-				hf("step: %q, command statement %v: %v\n\n", step.Name, i, stmt.CmdStr)
-				hf("  unstableLineOrder: %s\n", mustJSONMarshalIndent(stmt.unstableLineOrder))
-				hf("  doNotTrim: %s\n", mustJSONMarshalIndent(stmt.DoNotTrim))
-				hf("  negated: %s\n", mustJSONMarshalIndent(stmt.Negated))
-				hf("  randomReplace: %s\n", mustJSONMarshalIndent(stmt.RandomReplace))
-				hf("  sanitisers: %s\n", mustJSONMarshalIndent(stmt.sanitisers))
-				hf("  comparators: %s\n", mustJSONMarshalIndent(stmt.comparators))
+				key := fmt.Sprintf("step %q statement %v", step.Name, i)
+				if stmt.isInterrupt() {
+					hf(key, "%v, command statement %v: interrupt\n\n", stepHashName(step), i)
+					if resumed {
+						continue
+					}
+					cmdEchoFence := getFence()
+					pf("cat <<'%v'\n", cmdEchoFence)
+					pf("^C\n")
+					pf("%v\n", cmdEchoFence)
+					stopLongRunning(blocked[step.Terminal])
+					delete(blocked, step.Terminal)
+					continue
+				}
+				hf(key, "%v, command statement %v: %v\n\n", stepHashName(step), i, stmt.CmdStr)
+				hf(key+" unstableLineOrder", "  unstableLineOrder: %s\n", mustJSONMarshalIndent(stmt.unstableLineOrder))
+				hf(key+" doNotTrim", "  doNotTrim: %s\n", mustJSONMarshalIndent(stmt.DoNotTrim))
+				hf(key+" negated", "  negated: %s\n", mustJSONMarshalIndent(stmt.Negated))
+				hf(key+" randomReplace", "  randomReplace: %s\n", mustJSONMarshalIndent(stmt.RandomReplace))
+				hf(key+" sanitisers", "  sanitisers: %s\n", mustJSONMarshalIndent(stmt.sanitisers))
+				hf(key+" comparators", "  comparators: %s\n", mustJSONMarshalIndent(stmt.comparators))
+				// The following were added after the fields above, so we only
+				// write them to the hash when set in order that the hash of a
+				// statement that does not use them is unchanged
+				if stmt.Blocking != nil {
+					hf(key+" blocking", "  blocking: %s\n", mustJSONMarshalIndent(stmt.Blocking))
+				}
+				if stmt.Background != nil {
+					hf(key+" background", "  background: %s\n", mustJSONMarshalIndent(stmt.Background))
+				}
+				if stmt.waitFor != nil {
+					hf(key+" waitFor", "  waitFor: %s\n", mustJSONMarshalIndent(stmt.waitFor))
+				}
+				if stmt.Stdin != nil {
+					hf(key+" stdin", "  stdin: %s\n", mustJSONMarshalIndent(stmt.Stdin))
+				}
+				if stmt.exitCode != nil {
+					hf(key+" exitCode", "  exitCode: %s\n", mustJSONMarshalIndent(stmt.exitCode))
+				}
+				if resumed {
+					continue
+				}
 				// echo the command we will run
 				cmdEchoFence := getFence()
 				pf("cat <<'%v'\n", cmdEchoFence)
-				pf("$ %v\n", stmt.CmdStr)
+				pf("$ %v\n", stmt.displayCmd())
 				pf("%v\n", cmdEchoFence)
 				stmt.outputFence = getFence()
+				if stmt.isBlocking() || stmt.isBackground() {
+					lr := &longRunning{terminal: step.Terminal, step: step.Name, index: i, stmt: stmt}
+					startLongRunning(lr)
+					if stmt.isBlocking() {
+						blocked[step.Terminal] = lr
+					} else {
+						background[step.Terminal] = append(background[step.Terminal], lr)
+					}
+					continue
+				}
+				timed(step.Terminal, step.Name, i, stmt, "running")
 				pf("echo %v\n", stmt.outputFence)
-				pf("%v\n", stmt.CmdStr)
+				if stmt.Stdin != nil {
+					redirect, heredoc := stdin(stmt)
+					pf("{ %v\n}%v\n", stmt.CmdStr, redirect)
+					pf("%v", heredoc)
+				} else {
+					pf("%v\n", stmt.CmdStr)
+				}
 				pf("%s=$?\n", exitCodeVar)
 				pf("echo %v\n", stmt.outputFence)
-				if stmt.Negated != nil && *stmt.Negated {
-					pf("if [ $%s -eq 0 ]\n", exitCodeVar)
-				} else {
-					pf("if [ $%s -ne 0 ]\n", exitCodeVar)
+				// A statement that specifies an ExitCode has its exit code
+				// checked after the script has run: see runBashFile
+				if stmt.exitCode == nil {
+					if stmt.Negated != nil && *stmt.Negated {
+						pf("if [ $%s -eq 0 ]\n", exitCodeVar)
+					} else {
+						pf("if [ $%s -ne 0 ]\n", exitCodeVar)
+					}
+					pf("then\n")
+					pf("exit 1\n")
+					pf("fi\n")
 				}
-				pf("then\n")
-				pf("exit 1\n")
-				pf("fi\n")
 				pf("echo $%s\n", exitCodeVar)
 			}
 		case *uploadStep:
-			hf("step: %q, upload: target: %v, source: %v\n\n", step.Name, step.Target, step.Source)
+			hf(fmt.Sprintf("step %q upload", step.Name), "%v, upload: target: %v, source: %v\n\n", stepHashName(step), step.Target, step.Source)
+			if resumed {
+				break
+			}
 			cmdEchoFence := getFence()
 			pf("cat <<'%v'\n", cmdEchoFence)
 			pf("$ cat <<EOD > %v\n", step.Target)
 			pf("%v\n", step.Source)
 			pf("EOD\n")
 			pf("%v\n", cmdEchoFence)
+			// The local executor runs the script on the host, so the
+			// target is remapped under the scratch root of the "container"
+			target := step.Target
+			if *pdc.fExecutor == executorLocal {
+				target = fmt.Sprintf("\"$%v\"%v", localRootEnv, target)
+			}
 			fence := getFence()
-			pf("cat <<'%v' > %v\n", fence, step.Target)
+			pf("cat <<'%v' > %v\n", fence, target)
 			pf("%v\n", step.Source)
 			pf("%v\n", fence)
 			pf("%s=$?\n", exitCodeVar)
@@ -1557,13 +2527,62 @@ func (pdc *processDirContext) buildBashFile(g *guide) {
 		default:
 			panic(fmt.Errorf("can't yet handle steps of type %T", step))
 		}
+		step.setHash(fmt.Sprintf("%x", h.Sum(nil)))
+		if resumed || !checkpointable[si] || pdc.lookupCheckpoint(step.hash()) != nil {
+			continue
+		}
+		r.checkpoints = append(r.checkpoints, &checkpoint{
+			Hash:  step.hash(),
+			Image: checkpointRepository + ":" + step.hash(),
+			Guide: g.dir,
+			Step:  step.name(),
+			index: si,
+		})
+		pf("env -0 > %v\n", checkpointMarker(si, ".env"))
+		pf("pwd > %v\n", checkpointMarker(si, ".dir"))
+		pf("touch %v\n", checkpointMarker(si, ""))
+		pf("until [ -e %v ]; do sleep 0.1; done\n", checkpointMarker(si, ".done"))
+	}
+	// Every terminal waits for the last step to complete, signalled by the
+	// terminal that ran it
+	if handover > 0 {
+		pf("touch %v\n", syncFile(handover+1))
+	}
+	r.bashScripts = make(map[string]string)
+	for _, t := range g.Terminals {
+		sb = scripts[t.Name]
+		if handover > 0 && t.Name != lastTerm {
+			pf("%v\n", waitSyncFile(handover+1))
+		}
+		for _, lr := range background[t.Name] {
+			stopLongRunning(lr)
+		}
+		// Because of https://github.com/moby/moby/issues/43121 we add an
+		// additional \n (which will be read as \r\n) to ensure we have a
+		// trailing newline.
+		pf("echo")
+		r.bashScripts[t.Name] = sb.String()
 	}
-	// Because of https://github.com/moby/moby/issues/43121 we add an
-	// additional \n (which will be read as \r\n) to ensure we have a
-	// trailing newline.
-	pf("echo")
-	g.bashScript = sb.String()
-	g.Hash = fmt.Sprintf("%x", h.Sum(nil))
+	r.Hash = fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// scriptsDirVar is the name of the variable in a terminal's script that holds
+// the path of the scripts directory. The path is derived from the path of the
+// script itself, because the scripts directory is not necessarily mounted at
+// /scripts (for example when using the local executor). Named something
+// suitably esoteric to avoid user-declared variables
+const scriptsDirVar = "____scripts"
+
+// syncFile returns the path, within a terminal's script, of the file that
+// signals the nth handover between terminals
+func syncFile(n int) string {
+	return fmt.Sprintf("\"$%v/sync/%v\"", scriptsDirVar, n)
+}
+
+// waitSyncFile returns a bash statement that waits for the file that signals
+// the nth handover between terminals
+func waitSyncFile(n int) string {
+	return fmt.Sprintf("until [ -e %v ]; do sleep 0.1; done", syncFile(n))
 }
 
 func getFence() string {
@@ -1595,8 +2614,12 @@ func posLessThan(lhs, rhs token.Pos) bool {
 // In the special case that url is a file protocol, args is expected to be zero
 // length, and the -docker flag is ignored (that is to say, it is expected the
 // file can be accessed by the current process).
-func (pdc *processDirContext) doRequest(method string, endpoint string, conf *preguide.ServiceConfig, args ...interface{}) []byte {
-	var body io.Reader
+//
+// If -prestep-replay is set, the response is that recorded for the request,
+// and no request is made. If -prestep-record is set, the response is
+// recorded.
+func (gc *genCmd) doRequest(method string, endpoint string, conf *preguide.ServiceConfig, args ...interface{}) []byte {
+	var body []byte
 	if len(args) > 0 {
 		var w bytes.Buffer
 		enc := json.NewEncoder(&w)
@@ -1604,52 +2627,81 @@ func (pdc *processDirContext) doRequest(method string, endpoint string, conf *pr
 			err := enc.Encode(arg)
 			check(err, "failed to encode arg %v (%v): %v", i, pretty.Sprint(arg), err)
 		}
-		body = &w
+		body = w.Bytes()
+	}
+	if *gc.fPrestepReplay != "" {
+		return replayRequest(*gc.fPrestepReplay, method, endpoint, body)
+	}
+	resp := gc.request(method, endpoint, conf, body)
+	if *gc.fPrestepRecord != "" {
+		recordRequest(*gc.fPrestepRecord, method, endpoint, body, resp)
 	}
-	// We need Docker if we need to connect to networks
-	if len(conf.Networks) > 0 && !*pdc.fDocker {
-		cmd := pdc.newDockerRunner(conf.Networks,
+	return resp
+}
+
+// request performs the request for doRequest, where body is the
+// JSON-encoded args (if any)
+func (gc *genCmd) request(method string, endpoint string, conf *preguide.ServiceConfig, body []byte) []byte {
+	// We need a container if we need to connect to networks. The local
+	// executor has no containers, and hence no networks: rather than make the
+	// request from the host, where the endpoint is not (necessarily) the
+	// same service, we fail.
+	if len(conf.Networks) > 0 && !*gc.fDocker {
+		if *gc.fExecutor == executorLocal {
+			raise("the request to %v requires the networks %v, which are not supported by the %v executor", endpoint, strings.Join(conf.Networks, ", "), executorLocal)
+		}
+		c := containerConfig{
+			Env: append([]string{}, conf.Env...),
 			// Don't leave this container around
-			"--rm",
-		)
-		for _, e := range conf.Env {
-			cmd.Args = append(cmd.Args, "-e", e)
-		}
-		pdc.addSelfArgs(cmd)
-		// Now add the arguments to "ourselves"
-		cmd.Args = append(cmd.Args, "/runbin/preguide", "docker", method, endpoint)
+			AutoRemove: true,
+		}
+		gc.addSelfArgs(&c)
+		// Now add the arguments to "ourselves", including the policy for
+		// the request. The headers and the bearer token are passed via the
+		// environment of the container rather than as arguments, because
+		// they may well be secret.
+		c.Cmd = []string{"/runbin/preguide", "docker",
+			fmt.Sprintf("-timeout=%v", conf.Timeout),
+			fmt.Sprintf("-retries=%v", conf.Retries),
+			fmt.Sprintf("-backoff=%v", conf.Backoff),
+		}
+		if len(conf.Headers) > 0 {
+			headers, err := json.Marshal(conf.Headers)
+			check(err, "failed to encode headers: %v", err)
+			c.SecretEnv = append(c.SecretEnv, fmt.Sprintf("%v=%s", headersEnv, headers))
+			c.Cmd = append(c.Cmd, "-headersenv="+headersEnv)
+		}
+		if conf.BearerTokenEnv != "" {
+			c.Env = append(c.Env, conf.BearerTokenEnv)
+			c.Cmd = append(c.Cmd, "-bearertokenenv="+conf.BearerTokenEnv)
+		}
+		c.Cmd = append(c.Cmd, method, endpoint)
 		if body != nil {
-			byts, err := io.ReadAll(body)
-			check(err, "failed to read from body: %v", err)
-			cmd.Args = append(cmd.Args, string(byts))
+			c.Cmd = append(c.Cmd, string(body))
 		}
+		cmd := gc.newContainerRunner(conf.Networks, c)
 
 		var stdout, stderr bytes.Buffer
 		cmd.Stdout = &stdout
 		cmd.Stderr = &stderr
 
+		// The description of cmd includes only the names, not the values,
+		// of c.SecretEnv, hence is safe to include in the error
 		err := cmd.Run()
-		check(err, "failed to docker run %v: %v\n%s", strings.Join(cmd.Args, " "), err, stderr.Bytes())
+		check(err, "failed to docker run %v: %v\n%s", cmd, err, stderr.Bytes())
 
 		return stdout.Bytes()
 	}
 
-	req, err := http.NewRequest(method, endpoint, body)
-	check(err, "failed to build HTTP request for method %v, url %q: %v", method, endpoint, err)
-	resp, err := http.DefaultClient.Do(req)
-	check(err, "failed to perform HTTP request with args [%v]: %v", args, err)
-	if resp.StatusCode/100 != 2 {
-		raise("got non-success status code (%v) with args [%v]", resp.StatusCode, args)
-	}
-	respBody, err := io.ReadAll(resp.Body)
-	check(err, "failed to read response body for request %v: %v", req, err)
+	respBody, err := prestepRequest(conf, method, endpoint, body)
+	check(err, "failed %v request to %v: %v", method, endpoint, err)
 	return respBody
 }
 
-// addSelfArgs is ultimately responsible for adding the image that will be run
-// as part of this docker command. However it also adds any supporting arguments
-// e.g. like mounts
-func (gc *genCmd) addSelfArgs(dr *dockerRunnner) {
+// addSelfArgs is ultimately responsible for setting the image that will be run
+// for the container c. However it also adds any supporting configuration e.g.
+// like mounts
+func (gc *genCmd) addSelfArgs(c *containerConfig) {
 	bi := gc.buildInfo
 	// We can only use a published Docker image when we have full version information.
 	// And even then, we are not guaranteed to be using a commit/version that is
@@ -1660,13 +2712,11 @@ func (gc *genCmd) addSelfArgs(dr *dockerRunnner) {
 	// preguide should _not_ try to use a remote Docker image. The canonical example
 	// of this is when we are trying out a branch of preguide in PWG.
 	if os.Getenv("PREGUIDE_DEVEL_IMAGE") != "true" && bi.Main.Replace == nil && bi.Main.Version != "(devel)" && bi.Main.Version != "" {
-		dr.Args = append(dr.Args, fmt.Sprintf("playwithgo/preguide:%v", bi.Main.Version))
+		c.Image = fmt.Sprintf("playwithgo/preguide:%v", bi.Main.Version)
 		return
 	}
-	dr.Args = append(dr.Args,
-		fmt.Sprintf("--volume=%s:/runbin/preguide", gc.self),
-		imageBase,
-	)
+	c.Mounts = append(c.Mounts, mount{Source: gc.self, Target: "/runbin/preguide"})
+	c.Image = imageBase
 }
 
 type mdFile struct {
@@ -1721,6 +2771,24 @@ func (r refDirective) String() string {
 	return r.path.String()
 }
 
+// outrefDirective is a reference to a value in the Defs of the out CUE
+// package of a guide. Unlike refDirective, an outrefDirective can only be resolved once
+// the out package is known to exist, i.e. after the steps have been run (or
+// we have had a cache hit).
+type outrefDirective struct {
+	*baseDirective
+	path cue.Path
+
+	// vals maps a scenario name to the value the directive resolves to
+	// for the run of that scenario. For a guide without steps, the
+	// scenario name is ""
+	vals map[string]cue.Value
+}
+
+func (o outrefDirective) String() string {
+	return o.path.String()
+}
+
 const (
 	stepDirectiveName   = "step"
 	refDirectiveName    = "ref"
@@ -1871,6 +2939,11 @@ func (pdc *processDirContext) buildMarkdownFile(g *guide, path string, lang type
 						baseDirective: &bd,
 						path:          path,
 					})
+				case outrefDirectiveName:
+					res.directives = append(res.directives, &outrefDirective{
+						baseDirective: &bd,
+						path:          path,
+					})
 				}
 			case stepDirectiveName:
 				if len(rem) != 1 {
@@ -1925,7 +2998,7 @@ func (gc *genCmd) writeGuideStructures() {
 				Scenarios: guide.Scenarios,
 				Env:       guide.Env,
 			}
-			for _, ps := range guide.Presteps {
+			for _, ps := range guide.presteps {
 				s.Presteps = append(s.Presteps, &preguide.Prestep{
 					Package: ps.Package,
 					Path:    ps.Path,
@@ -1954,22 +3027,32 @@ func (gc *genCmd) writeGuideStructures() {
 	check(err, "failed to write guide structures output to %v: %v", outPath, err)
 }
 
+// sortSteps sorts the Steps of each run in the Outputs of the encoded guide
+// n according to their Order
 func sortSteps(n ast.Node) ast.Node {
 	s := n.(*ast.StructLit)
-	stepsField := structField(s, "Steps")
-	if stepsField == nil {
+	outputsField := structField(s, "Outputs")
+	if outputsField == nil {
 		// This should never happen... because we are in control of the conversion
-		panic(fmt.Errorf("failed to find Steps field in %v", pretty.Sprint(s)))
-	}
-	stepsVal := stepsField.Value.(*ast.StructLit)
-	sort.Slice(stepsVal.Elts, func(i, j int) bool {
-		lhs, rhs := stepsVal.Elts[i].(*ast.Field), stepsVal.Elts[j].(*ast.Field)
-		lhsOrder := structField(lhs.Value, "Order").Value.(*ast.BasicLit)
-		rhsOrder := structField(rhs.Value, "Order").Value.(*ast.BasicLit)
-		lhsv, _ := strconv.Atoi(lhsOrder.Value)
-		rhsv, _ := strconv.Atoi(rhsOrder.Value)
-		return lhsv < rhsv
-	})
+		panic(fmt.Errorf("failed to find Outputs field in %v", pretty.Sprint(s)))
+	}
+	for _, scenario := range outputsField.Value.(*ast.StructLit).Elts {
+		for _, run := range scenario.(*ast.Field).Value.(*ast.StructLit).Elts {
+			stepsField := structField(run.(*ast.Field).Value, "Steps")
+			if stepsField == nil {
+				panic(fmt.Errorf("failed to find Steps field in %v", pretty.Sprint(run)))
+			}
+			stepsVal := stepsField.Value.(*ast.StructLit)
+			sort.Slice(stepsVal.Elts, func(i, j int) bool {
+				lhs, rhs := stepsVal.Elts[i].(*ast.Field), stepsVal.Elts[j].(*ast.Field)
+				lhsOrder := structField(lhs.Value, "Order").Value.(*ast.BasicLit)
+				rhsOrder := structField(rhs.Value, "Order").Value.(*ast.BasicLit)
+				lhsv, _ := strconv.Atoi(lhsOrder.Value)
+				rhsv, _ := strconv.Atoi(rhsOrder.Value)
+				return lhsv < rhsv
+			})
+		}
+	}
 	return s
 }
 
@@ -1999,74 +3082,3 @@ func structField(decl ast.Decl, field string) *ast.Field {
 	}
 	return nil
 }
-
-// dockerRunnner is a convenience type used to wrap the three call
-// dance required to run a docker container with multiple
-// networks attached
-type dockerRunnner struct {
-	pdc *processDirContext
-
-	// DockerArgs are the flags to pass to each docker command
-	DockerArgs []string
-
-	// Env is the environment passed to each docker command
-	Env []string
-
-	Path     string
-	Args     []string
-	Stdin    io.Reader
-	Stdout   io.Writer
-	Stderr   io.Writer
-	Networks []string
-}
-
-func (pdc *processDirContext) newDockerRunner(networks []string, args ...string) *dockerRunnner {
-	return &dockerRunnner{
-		pdc:      pdc,
-		Networks: append([]string{}, networks...),
-		Args:     append([]string{}, args...),
-	}
-}
-
-func (dr *dockerRunnner) Run() error {
-	createCmd := exec.Command("docker", "create")
-	createCmd.Env = dr.Env
-	createCmd.Args = append(createCmd.Args, dr.Args...)
-	var createStdout, createStderr bytes.Buffer
-	createCmd.Stdout = &createStdout
-	createCmd.Stderr = &createStderr
-
-	if err := createCmd.Run(); err != nil {
-		return fmt.Errorf("failed %v: %v\n%s", createCmd, err, createStderr.Bytes())
-	}
-
-	instance := strings.TrimSpace(createStdout.String())
-
-	for _, network := range dr.Networks {
-		connectCmd := exec.Command("docker", "network", "connect", network, instance)
-		if out, err := connectCmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed %v: %v\n%s", connectCmd, err, out)
-		}
-	}
-
-	startCmd := exec.Command("docker", "start", "-a", instance)
-	startCmd.Stdin = dr.Stdin
-	startCmd.Stdout = dr.Stdout
-	startCmd.Stderr = dr.Stderr
-
-	return startCmd.Run()
-}
-
-func (dr *dockerRunnner) CombinedOutput() ([]byte, error) {
-	if dr.Stdout != nil {
-		return nil, fmt.Errorf("cmd Stdout already set")
-	}
-	if dr.Stderr != nil {
-		return nil, fmt.Errorf("cmd Sderr already set")
-	}
-	var comb bytes.Buffer
-	dr.Stdout = &comb
-	dr.Stderr = &comb
-	err := dr.Run()
-	return comb.Bytes(), err
-}
@@ -10,8 +10,12 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"text/template"
 	"text/template/parse"
+	"time"
 
 	"cuelang.org/go/cue"
 	"github.com/play-with-go/preguide"
@@ -35,8 +39,12 @@ type guide struct {
 	mdFiles []mdFile
 	langs   []string
 
+	// presteps are the presteps declared by the guide. Each run of the
+	// guide has its own copy of these presteps, because the result of
+	// running a prestep is specific to a run
+	presteps []*guidePrestep
+
 	// Embed guideStructure once we have a solution to cuelang.org/issue/376
-	Presteps  []*guidePrestep
 	Terminals []*preguide.Terminal
 	Scenarios []*preguide.Scenario
 	Networks  []string
@@ -44,16 +52,79 @@ type guide struct {
 
 	FilenameComment *bool
 
-	Steps      steps
-	bashScript string
-	Hash       string
-	steps      []step
+	// timeout is the default timeout for each statement of the guide, if
+	// specified
+	timeout *time.Duration
+
+	// stepPaths are the absolute paths of the files referenced by the Path
+	// of a step, i.e. the files that are input to the guide in addition to
+	// its CUE package and markdown files
+	stepPaths []string
+
+	// exitCodes are the ExitCode constraints of the statements of the
+	// guide, compiled when the guide is loaded
+	exitCodes map[types.ExitCode]cue.Value
+
+	// stepsByName and steps are the steps declared by the guide for each
+	// language, by name and in declaration order respectively. These are
+	// used to validate directives. Each run of the guide has its own copy
+	// of the steps, because the output of a step is specific to a run
+	stepsByName map[types.LangCode]steps
+	steps       map[types.LangCode][]step
+
+	// Outputs maps a scenario name and language to the run of the guide's
+	// steps for that scenario and language. There is only a run for a
+	// language other than English if that language overrides at least one
+	// step; otherwise the language shares the run of the English steps.
+	Outputs map[string]map[types.LangCode]*guideRun
+
+	// runs are the runs of the guide, in scenario declaration order
+	runs []*guideRun
 
 	val    cue.Value
 	outVal cue.Value
 
 	outputGuide *guide
 
+	// delims are the text/template delimiters for guide prose and
+	// step variable expansion
+	Delims [2]string
+}
+
+// guideRun is the running of a guide's steps for a given scenario and
+// language. guideRun corresponds to the
+// github.com/play-with-go/preguide/out.#Output definition
+type guideRun struct {
+	Presteps   []*guidePrestep
+	Hash       string
+	HashInputs []*hashInput
+	Steps      steps
+
+	scenario *preguide.Scenario
+	lang     types.LangCode
+
+	// steps are the Steps of the run in declaration order
+	steps []step
+
+	// bashScripts maps a terminal name to the script to run in that
+	// terminal
+	bashScripts map[string]string
+
+	// timed maps a terminal name to the timed sections of the script for
+	// that terminal, in the order in which they are run
+	timed map[string][]*timedSection
+
+	// resume is the number of leading steps of the run that are not run,
+	// because the run resumes from checkpoint, the state of a container
+	// after those steps. Their output is that of the previous run. See
+	// resumeFromCheckpoint.
+	resume     int
+	checkpoint *checkpoint
+
+	// checkpoints are the checkpoints to be taken as the script runs, in
+	// step order. See buildBashFile.
+	checkpoints []*checkpoint
+
 	vars []string
 
 	// varMap holds a mapping from {{.VAR}}-style variable name to value.  When
@@ -62,40 +133,85 @@ type guide struct {
 	// empty. In the latter case, the map is still used in the phase of writing
 	// the guide output markdown because the variable name in {{.VAR}} template
 	// blocks is normalised and escaped.
-	//
-	// This will need to be made per language per scenario when that support is
-	// added
 	varMap map[string]string
 
-	// delims are the text/template delimiters for guide prose and
-	// step variable expansion
-	Delims [2]string
+	// secrets are the names of the variables in varMap the values of which
+	// are secret
+	secrets map[string]bool
 }
 
-// TODO drop this when we support multiple terminals
-func (g *guide) Image() string {
-	if got := len(g.Terminals[0].Scenarios); got != 1 {
-		panic(fmt.Errorf("expected just 1 scenario, saw %v", got))
+// redact returns s with the value of each secret variable replaced
+func (r *guideRun) redact(s string) string {
+	var secrets []string
+	for name := range r.secrets {
+		if r.varMap[name] != "" {
+			secrets = append(secrets, name)
+		}
+	}
+	if len(secrets) == 0 {
+		return s
 	}
-	for _, v := range g.Terminals[0].Scenarios {
-		return v.Image
+	// Replace the longest values first, in case some values are substrings
+	// of others
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(r.varMap[secrets[i]]) > len(r.varMap[secrets[j]])
+	})
+	for _, name := range secrets {
+		s = strings.ReplaceAll(s, r.varMap[name], "<redacted:"+name+">")
 	}
-	panic("should not be here")
+	return s
 }
 
-// fileSuffix returns a filename suffix appropriate for guide g.
-// When we later come to add support for multiple languages and
-// scenarios, this signature and logic will need to change
-func (g *guide) fileSuffix() string {
-	lang := g.langs[0]
-	var scenario string
-	if len(g.steps) > 0 {
-		scenario = g.Scenarios[0].Name + "_"
+// run returns the run of g for the given scenario and language, or nil if
+// there is no such run
+func (g *guide) run(scenario string, lang types.LangCode) *guideRun {
+	return g.Outputs[scenario][lang]
+}
+
+// langRun returns the run of g that applies to the given scenario and
+// language, falling back to the run for English if lang does not have its
+// own run
+func (g *guide) langRun(scenario string, lang types.LangCode) *guideRun {
+	if r := g.run(scenario, lang); r != nil {
+		return r
+	}
+	return g.run(scenario, "en")
+}
+
+// hasLang returns whether lang is one of the languages of g
+func (g *guide) hasLang(lang types.LangCode) bool {
+	for _, l := range g.langs {
+		if types.LangCode(l) == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// numRuns returns the number of runs in g.Outputs
+func (g *guide) numRuns() int {
+	var res int
+	for _, langs := range g.Outputs {
+		res += len(langs)
+	}
+	return res
+}
+
+// image returns the image to use for terminal t in the scenario of run r.
+func (r *guideRun) image(t *preguide.Terminal) string {
+	ts, ok := t.Scenarios[r.scenario.Name]
+	if !ok {
+		panic(fmt.Errorf("terminal %v does not declare an image for scenario %v", t.Name, r.scenario.Name))
 	}
-	return scenario + lang
+	return ts.Image
+}
+
+// fileSuffix returns a filename suffix appropriate for the run r.
+func (r *guideRun) fileSuffix() string {
+	return r.scenario.Name + "_" + string(r.lang)
 }
 
-// updateFromOutput is used to update g from an ouput guide out.
+// updateFromOutput is used to update r from an ouput run out.
 // This is typically used when we have a cache hit. That means,
 // the input steps are equivalent, in execution terms, to the
 // steps in the output schema.
@@ -104,25 +220,32 @@ func (g *guide) fileSuffix() string {
 // not affect execution. e.g. on an upload step, the Renderer
 // used. Hence we need to copy across fields that represent
 // execution output from the output steps onto the input steps.
-func (g *guide) updateFromOutput(out *guide) {
+func (r *guideRun) updateFromOutput(out *guideRun) {
 	for sn, ostep := range out.Steps {
-		istep := g.Steps[sn]
+		istep := r.Steps[sn]
 		istep.setOutputFrom(ostep)
 	}
-	// Populate the guide's varMap based on the variables that resulted
+	// Populate the run's varMap based on the variables that resulted
 	// when the script did run. Empty values are fine, we just need
 	// the environment variable names.
 	for _, ps := range out.Presteps {
 		for _, v := range ps.Variables {
-			g.varMap[v] = ""
+			r.varMap[v] = ""
 		}
 	}
-	// Now set the guide's Presteps to be that of the output because
+	// Now set the run's Presteps to be that of the output because
 	// we known they are equivalent in terms of inputs at this stage
 	// i.e. what presteps will run, the order, the args etc, because
 	// this check happened as part of the hash check.
-	g.Presteps = out.Presteps
+	r.Presteps = out.Presteps
+
+}
 
+// hashInput corresponds to the github.com/play-with-go/preguide/out.#HashInput
+// definition
+type hashInput struct {
+	Key   string
+	Value string
 }
 
 // Embed *types.Prestep once we have a solution to cuelang.org/issue/376
@@ -136,145 +259,173 @@ type guidePrestep struct {
 
 // writeGuideOutput writes the markdown files of output for a guide
 // that result from the combination of the configuration and input
-// to a guide.
+// to a guide. A markdown file is written for each run of the guide, i.e.
+// for each scenario. A guide without steps has no runs, in which case
+// a single markdown file is written per language.
 func (pdc *processDirContext) writeGuideOutput() {
 	g := pdc.guide
 
-	// TODO: multi language and scenario support. When we have multiple language
-	// support we will be running writeGuideOutput() in the context of a language (and
-	// scenario). For now we simply use the guide itself, knowing we will have exactly
-	// one language and one scenario if we steps, else we have zero scenarios
-
-	var err error
-
 	postsDir := g.target
-	err = os.MkdirAll(postsDir, 0777)
+	err := os.MkdirAll(postsDir, 0777)
 	check(err, "failed to os.MkdirAll %v: %v", postsDir, err)
 
+	for _, md := range g.mdFiles {
+		if len(g.runs) == 0 {
+			pdc.writeMarkdownOutput(md, nil)
+			continue
+		}
+		for _, scenario := range g.Scenarios {
+			pdc.writeMarkdownOutput(md, g.langRun(scenario.Name, md.lang))
+		}
+	}
+}
+
+// writeMarkdownOutput writes the output for the markdown file md that
+// results from the run r. r is nil in the case of a guide without steps.
+// Note that r is the run for English in case the language of md does not
+// override any steps.
+func (pdc *processDirContext) writeMarkdownOutput(md mdFile, r *guideRun) {
+	g := pdc.guide
+
 	renderOpts := renderOptions{
 		mode:            pdc.fMode,
 		FilenameComment: g.FilenameComment,
 	}
 
-	for _, md := range g.mdFiles {
+	suffix := string(md.lang)
+	var scenario string
+	varMap := make(map[string]string)
+	if r != nil {
+		scenario = r.scenario.Name
+		suffix = scenario + "_" + suffix
+		varMap = r.varMap
+	}
 
-		outFilePath := filepath.Join(postsDir, fmt.Sprintf("%v_%v%v", g.name, g.fileSuffix(), md.ext))
-		outFile, err := os.Create(outFilePath)
-		check(err, "failed to open %v for writing: %v", outFilePath, err)
-
-		// TODO: support all front-matter formats
-		switch pdc.fMode {
-		case types.ModeGitHub:
-			fmt.Fprintf(outFile, "<!--- Code generated by preguide from %s; DO NOT EDIT. --->\n\n", pdc.relpath(md.path))
-		case types.ModeJekyll:
-			switch md.frontFormat {
-			case "yaml":
-				fmt.Fprintln(outFile, "---")
-				if len(md.frontMatter) > 0 {
-					enc := yaml.NewEncoder(outFile)
-					err := enc.Encode(md.frontMatter)
-					check(err, "failed to encode front matter for %v: %v", outFilePath, err)
-				}
-				fmt.Fprintln(outFile, "---")
-			case "":
-			default:
-				panic(fmt.Errorf("don't yet support front-matter type of %v", md.frontFormat))
+	outFilePath := filepath.Join(g.target, fmt.Sprintf("%v_%v%v", g.name, suffix, md.ext))
+	outFile, err := os.Create(outFilePath)
+	check(err, "failed to open %v for writing: %v", outFilePath, err)
+
+	// TODO: support all front-matter formats
+	switch pdc.fMode {
+	case types.ModeGitHub:
+		fmt.Fprintf(outFile, "<!--- Code generated by preguide from %s; DO NOT EDIT. --->\n\n", pdc.relpath(md.path))
+	case types.ModeJekyll:
+		switch md.frontFormat {
+		case "yaml":
+			fmt.Fprintln(outFile, "---")
+			if len(md.frontMatter) > 0 {
+				enc := yaml.NewEncoder(outFile)
+				err := enc.Encode(md.frontMatter)
+				check(err, "failed to encode front matter for %v: %v", outFilePath, err)
 			}
+			fmt.Fprintln(outFile, "---")
+		case "":
+		default:
+			panic(fmt.Errorf("don't yet support front-matter type of %v", md.frontFormat))
 		}
+	}
 
-		var buf bytes.Buffer
+	var buf bytes.Buffer
 
-		if len(md.directives) > 0 {
-			// TODO: implement fallback to en for directives
-			pos := 0
-			for _, d := range md.directives {
-				buf.Write(md.content[pos:d.Pos().offset])
-				switch d := d.(type) {
-				case *stepDirective:
-					g.Steps[d.name].render(&buf, renderOpts)
-				case *refDirective:
-					switch d.val.Kind() {
-					case cue.StringKind:
-						v, _ := d.val.String()
-						buf.WriteString(v)
-					}
+	if len(md.directives) > 0 {
+		pos := 0
+		for _, d := range md.directives {
+			buf.Write(md.content[pos:d.Pos().offset])
+			switch d := d.(type) {
+			case *stepDirective:
+				r.Steps[d.name].render(&buf, renderOpts)
+			case *refDirective:
+				switch d.val.Kind() {
+				case cue.StringKind:
+					v, _ := d.val.String()
+					buf.WriteString(v)
+				}
+			case *outrefDirective:
+				v, ok := d.vals[scenario]
+				switch {
+				case pdc.fMode == types.ModeRaw:
+					// In -raw mode the out package is not written, hence
+					// outref directives are not resolved: we write the
+					// directive as is, quoted such that it survives the
+					// {{.ENV}} normalising below
+					src := string(md.content[d.Pos().offset:d.End().offset])
+					buf.WriteString(g.Delims[0] + strconv.Quote(src) + g.Delims[1])
+				case !ok:
+					raise("%v:%v: {%v} was not resolved for scenario %q", pdc.relpath(md.path), d.Pos(), d.String(), scenario)
 				default:
-					panic(fmt.Errorf("don't yet know how to handle %T directives", d))
+					v, _ := directiveValueString(v)
+					buf.WriteString(v)
 				}
-				pos = d.End().offset
+			default:
+				panic(fmt.Errorf("don't yet know how to handle %T directives", d))
 			}
-			buf.Write(md.content[pos:])
-		} else {
-			buf.Write(md.content)
+			pos = d.End().offset
 		}
+		buf.Write(md.content[pos:])
+	} else {
+		buf.Write(md.content)
+	}
 
-		switch pdc.fMode {
-		case types.ModeJekyll:
-			// Now write a simple <script> block that declares some useful variables
-			// that will be picked up by postLayout.js
-			//
-			// TODO: obviously this code needs to change when we run multiple
-			// scenarios.
-			if len(g.Scenarios) > 0 {
-				fmt.Fprintf(&buf, "<script>let pageGuide=%q; let pageLanguage=%q; let pageScenario=%q;</script>\n", g.name, md.lang, g.Scenarios[0].Name)
-			}
+	switch pdc.fMode {
+	case types.ModeJekyll:
+		// Now write a simple <script> block that declares some useful variables
+		// that will be picked up by postLayout.js
+		if r != nil {
+			fmt.Fprintf(&buf, "<script>let pageGuide=%q; let pageLanguage=%q; let pageScenario=%q;</script>\n", g.name, md.lang, scenario)
 		}
+	}
 
-		// At this stage, random values have been sanitised to deterministic
-		// values, and env values have been substituted for {{{.ENV}}}
-		// equivalents (using whatever delimeters are configured for the guide).
-		// But critically, in command/code blocks, { and } have been replaced with
-		// their HTML entity equivalents.
-		//
-		// Therefore the only remaining step is to replace { and } instances in
-		// {{{.ENV}}} templates that appear in the prose. We do this using {% raw
-		// %} blocks in Jekyll mode because we can't know whether the user will
-		// use such a template within a `` code element, in which case the
-		// ampersand in &#123; would be interpreted literally and &#123; would be
-		// rendered as  &#123;.
-		//
-		// If the author wants to include a literal { or } in their markdown
-		// input, they can use &#123; or &#125;
-		//
-		// Script output is assumed to only ever include literal { and } values
-		// hence that is unconditionally escaped using &#123; and &#125;
-		repls := g.varMap
-		if pdc.fMode == types.ModeJekyll {
-			repls = make(map[string]string)
-			for v := range g.varMap {
-				repls[v] = "{% raw %}" + g.Delims[0] + "." + v + g.Delims[1] + "{% endraw %}"
-			}
+	// At this stage, random values have been sanitised to deterministic
+	// values, and env values have been substituted for {{{.ENV}}}
+	// equivalents (using whatever delimeters are configured for the guide).
+	// But critically, in command/code blocks, { and } have been replaced with
+	// their HTML entity equivalents.
+	//
+	// Therefore the only remaining step is to replace { and } instances in
+	// {{{.ENV}}} templates that appear in the prose. We do this using {% raw
+	// %} blocks in Jekyll mode because we can't know whether the user will
+	// use such a template within a `` code element, in which case the
+	// ampersand in &#123; would be interpreted literally and &#123; would be
+	// rendered as  &#123;.
+	//
+	// If the author wants to include a literal { or } in their markdown
+	// input, they can use &#123; or &#125;
+	//
+	// Script output is assumed to only ever include literal { and } values
+	// hence that is unconditionally escaped using &#123; and &#125;
+	repls := varMap
+	if pdc.fMode == types.ModeJekyll {
+		repls = make(map[string]string)
+		for v := range varMap {
+			repls[v] = "{% raw %}" + g.Delims[0] + "." + v + g.Delims[1] + "{% endraw %}"
 		}
-		t := template.New("prose {{.ENV}} normalising and escaping")
-		pt, err := parse.Parse(t.Name(), buf.String(), g.Delims[0], g.Delims[1])
-		check(err, "failed to parse output for prose {{.ENV}} normalising and escaping")
-		t.Delims(g.Delims[0], g.Delims[1])
-		t.AddParseTree(t.Name(), pt[t.Name()])
-		t.Option("missingkey=error")
-		err = t.Execute(outFile, repls)
-		check(err, "failed to execute prose {{.ENV}} normalising and escaping template: %v", err)
-
-		err = outFile.Close()
-		check(err, "failed to close %v: %v", outFilePath, err)
 	}
+	t := template.New("prose {{.ENV}} normalising and escaping")
+	pt, err := parse.Parse(t.Name(), buf.String(), g.Delims[0], g.Delims[1])
+	check(err, "failed to parse output for prose {{.ENV}} normalising and escaping")
+	t.Delims(g.Delims[0], g.Delims[1])
+	t.AddParseTree(t.Name(), pt[t.Name()])
+	t.Option("missingkey=error")
+	err = t.Execute(outFile, repls)
+	check(err, "failed to execute prose {{.ENV}} normalising and escaping template: %v", err)
+
+	err = outFile.Close()
+	check(err, "failed to close %v: %v", outFilePath, err)
 }
 
-// writeLog writes a
+// writeLog writes a log of the steps of each run of the guide
 func (pdc *processDirContext) writeLog() {
 	g := pdc.guide
 
-	// TODO: multi language and scenario support. When we have multiple language
-	// support we will be running writeLog() in the context of a language (and
-	// scenario). For now we simply use the guide itself, knowing we will have exactly
-	// one language and one scenario if we steps, else we have zero scenarios
-
-	var buf bytes.Buffer
-	for _, step := range g.steps {
-		step.renderLog(pdc.fMode, &buf)
+	for _, r := range g.runs {
+		var buf bytes.Buffer
+		for _, step := range r.steps {
+			step.renderLog(pdc.fMode, &buf)
+		}
+		logFilePath := filepath.Join(g.dir, fmt.Sprintf("%v_log.txt", r.fileSuffix()))
+		err := os.WriteFile(logFilePath, buf.Bytes(), 0666)
+		check(err, "failed to write log output to %v: %v", logFilePath, err)
 	}
-	logFilePath := filepath.Join(g.dir, fmt.Sprintf("%v_log.txt", g.fileSuffix()))
-	err := os.WriteFile(logFilePath, buf.Bytes(), 0666)
-	check(err, "failed to write log output to %v: %v", logFilePath, err)
 }
 
 func mustJSONMarshalIndent(i interface{}) []byte {
@@ -283,3 +434,14 @@ func mustJSONMarshalIndent(i interface{}) []byte {
 	return byts
 
 }
+
+// addStepPath records p as the absolute path of a file referenced by the
+// Path of a step
+func (g *guide) addStepPath(p string) {
+	for _, sp := range g.stepPaths {
+		if sp == p {
+			return
+		}
+	}
+	g.stepPaths = append(g.stepPaths, p)
+}
@@ -35,10 +35,20 @@ func (hc *helpCmd) run(args []string) error {
 	}
 	var u func() string
 	switch args[0] {
+	case "cache":
+		u = hc.cacheCmd.usage
 	case "gen":
 		u = hc.genCmd.usage
 	case "init":
 		u = hc.initCmd.usage
+	case "prestep":
+		u = hc.prestepCmd.usage
+	case "presteps":
+		u = hc.prestepsCmd.usage
+	case "serve":
+		u = hc.serveCmd.usage
+	case "vet":
+		u = hc.vetCmd.usage
 	case "help":
 		u = hc.usage
 	default:
@@ -5,29 +5,56 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template"
+
+	"cuelang.org/go/cue/ast"
+	"cuelang.org/go/cue/literal"
+	"github.com/play-with-go/preguide"
 )
 
+// initCmd creates a new guide in a directory, as a starting point for a guide
+// author. The guide comprises a guide.cue file that declares a single
+// terminal, scenario and step, and an en.markdown file that references that
+// step. The directory is established as a CUE module, with the
+// github.com/play-with-go/preguide CUE module written to its cue.mod/pkg
+// directory, such that the guide's CUE package can be validated with cue vet
+// (or preguide cue vet) as well as by preguide gen.
 type initCmd struct {
 	*runner
 	fs           *flag.FlagSet
 	flagDefaults string
+	fTerminal    *string
+	fImage       *string
+	fScenario    *string
 }
 
+// scenarioNameRegexp is the constraint on the name of a scenario, per the
+// #Guide definition
+var scenarioNameRegexp = regexp.MustCompile("^[a-zA-Z0-9]+$")
+
 func newInitCmd(r *runner) *initCmd {
 	res := &initCmd{
 		runner: r,
 	}
 	res.flagDefaults = newFlagSet("preguide init", func(fs *flag.FlagSet) {
 		res.fs = fs
+		res.fTerminal = fs.String("terminal", "term1", "the name of the terminal declared by the guide")
+		res.fImage = fs.String("image", "golang", "the image used by the terminal for the scenario")
+		res.fScenario = fs.String("scenario", "go", "the name of the scenario declared by the guide")
 	})
 	return res
 }
 
 func (ic *initCmd) usage() string {
 	return fmt.Sprintf(`
-usage: preguide init
+usage: preguide init [-terminal name -image ref -scenario name] <dir>
 
 %s`[1:], ic.flagDefaults)
 }
@@ -37,5 +64,139 @@ func (ic *initCmd) usageErr(format string, args ...interface{}) usageErr {
 }
 
 func (ic *initCmd) run(args []string) error {
+	if err := ic.fs.Parse(args); err != nil {
+		return ic.usageErr("failed to parse flags: %v", err)
+	}
+	if len(ic.fs.Args()) != 1 {
+		return ic.usageErr("expected a single directory argument")
+	}
+	if *ic.fTerminal == "" {
+		return ic.usageErr("-terminal must not be empty")
+	}
+	if *ic.fImage == "" {
+		return ic.usageErr("-image must not be empty")
+	}
+	if !scenarioNameRegexp.MatchString(*ic.fScenario) {
+		return ic.usageErr("invalid -scenario %q: must match %v", *ic.fScenario, scenarioNameRegexp)
+	}
+	dir, err := filepath.Abs(ic.fs.Args()[0])
+	check(err, "failed to make path %q absolute: %v", ic.fs.Args()[0], err)
+
+	// We only create a guide in a new (or empty) directory, so that we never
+	// overwrite an author's files
+	es, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		raise("failed to read directory %v: %v", dir, err)
+	}
+	if len(es) > 0 {
+		raise("%v already exists and is not empty", ic.relpath(dir))
+	}
+
+	data := initData{
+		Name:     filepath.Base(dir),
+		Terminal: *ic.fTerminal,
+		Image:    *ic.fImage,
+		Scenario: *ic.fScenario,
+	}
+	ic.writeTemplate(filepath.Join(dir, "guide.cue"), guideCUETemplate, data)
+	ic.writeTemplate(filepath.Join(dir, "en.markdown"), enMarkdownTemplate, data)
+	ic.writeTemplate(filepath.Join(dir, "cue.mod", "module.cue"), moduleCUETemplate, data)
+	ic.writeCUEModule(filepath.Join(dir, "cue.mod", "pkg", "github.com", "play-with-go", "preguide"))
 	return nil
 }
+
+// initData is the data used to execute the templates for the files of a new
+// guide
+type initData struct {
+	Name     string
+	Terminal string
+	Image    string
+	Scenario string
+}
+
+var initFuncs = template.FuncMap{
+	// label returns s as a CUE label, quoting it where s is not a valid
+	// identifier
+	"label": func(s string) string {
+		if ast.IsValidIdent(s) {
+			return s
+		}
+		return literal.Label.Quote(s)
+	},
+	// quote returns s as a CUE string
+	"quote": literal.String.Quote,
+}
+
+var guideCUETemplate = template.Must(template.New("guide.cue").Funcs(initFuncs).Parse(`
+package guide
+
+import "github.com/play-with-go/preguide"
+
+preguide.#Guide
+
+Scenarios: {{label .Scenario}}: preguide.#Scenario & {
+	Description: {{quote .Scenario}}
+}
+
+Terminals: {{label .Terminal}}: preguide.#Terminal & {
+	Description: "The main terminal"
+	Scenarios: {{label .Scenario}}: Image: {{quote .Image}}
+}
+
+Steps: hello: preguide.#Command & {
+	Stmts: """
+		echo "Hello, world!"
+		"""
+}
+`[1:]))
+
+var enMarkdownTemplate = template.Must(template.New("en.markdown").Funcs(initFuncs).Parse(`
+---
+title: {{quote .Name}}
+---
+
+# Introduction
+
+This guide runs a single step:
+
+{{"{{"}} step "hello" {{"}}"}}
+`[1:]))
+
+var moduleCUETemplate = template.Must(template.New("module.cue").Funcs(initFuncs).Parse(`
+module: {{quote .Name}}
+`[1:]))
+
+// writeTemplate writes the result of executing t with data to the file fn,
+// creating any parent directories as required
+func (ic *initCmd) writeTemplate(fn string, t *template.Template, data initData) {
+	var b bytes.Buffer
+	err := t.Execute(&b, data)
+	check(err, "failed to execute template for %v: %v", fn, err)
+	writeInitFile(fn, b.Bytes())
+}
+
+// writeCUEModule writes the github.com/play-with-go/preguide CUE module
+// embedded in preguide to dir
+func (ic *initCmd) writeCUEModule(dir string) {
+	mod := preguide.CUEModule()
+	err := fs.WalkDir(mod, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		contents, err := fs.ReadFile(mod, path)
+		if err != nil {
+			return err
+		}
+		writeInitFile(filepath.Join(dir, filepath.FromSlash(path)), contents)
+		return nil
+	})
+	check(err, "failed to write github.com/play-with-go/preguide CUE module: %v", err)
+}
+
+func writeInitFile(fn string, contents []byte) {
+	dir := filepath.Dir(fn)
+	err := os.MkdirAll(dir, 0777)
+	check(err, "failed to create directory %v: %v", dir, err)
+	err = os.WriteFile(fn, contents, 0666)
+	check(err, "failed to write %v: %v", fn, err)
+}
@@ -48,6 +48,11 @@ func main1() int {
 	r.helpCmd = newHelpCmd(r)
 	r.dockerCmd = newDockerCmd(r)
 	r.cueCmd = newCueCmd(r)
+	r.prestepCmd = newPrestepCmd(r)
+	r.prestepsCmd = newPrestepsCmd(r)
+	r.vetCmd = newVetCmd(r)
+	r.serveCmd = newServeCmd(r)
+	r.cacheCmd = newCacheCmd(r)
 
 	err := r.mainerr()
 	if err == nil {
@@ -73,6 +78,12 @@ type runner struct {
 	dockerCmd *dockerCmd
 	cueCmd    *cueCmd
 
+	prestepCmd  *prestepCmd
+	prestepsCmd *prestepsCmd
+	vetCmd      *vetCmd
+	serveCmd    *serveCmd
+	cacheCmd    *cacheCmd
+
 	// runtime is the cue.Runtime used for all CUE operations
 	context *cue.Context
 
@@ -147,6 +158,16 @@ func (r *runner) mainerr() (err error) {
 		return r.helpCmd.run(args[1:])
 	case "cue":
 		return r.cueCmd.run(args[1:])
+	case "prestep":
+		return r.prestepCmd.run(args[1:])
+	case "presteps":
+		return r.prestepsCmd.run(args[1:])
+	case "vet":
+		return r.vetCmd.run(args[1:])
+	case "serve":
+		return r.serveCmd.run(args[1:])
+	case "cache":
+		return r.cacheCmd.run(args[1:])
 	default:
 		return r.usageErr("unknown command: " + cmd)
 	}
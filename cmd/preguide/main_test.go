@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -33,6 +35,14 @@ func TestMain(m *testing.M) {
 	os.Exit(testscript.RunMain(m, map[string]func() int{
 		"cmd-cmpregex": cmdCmpRegex,
 		"preguide": func() int {
+			// The fake executor is only part of the test binary, hence in
+			// that case we run preguide in-process
+			if os.Getenv("PREGUIDE_EXECUTOR") == executorFake {
+				testExecutors[executorFake] = func() Executor {
+					return newFakeExecutor()
+				}
+				return main1()
+			}
 			self := os.Getenv("PREGUIDE_SELF_BUILD")
 			if self == "" {
 				fmt.Fprintln(os.Stderr, "PREGUIDE_SELF_BUILD env var not set")
@@ -45,8 +55,12 @@ func TestMain(m *testing.M) {
 }
 
 func TestScripts(t *testing.T) {
+	// Without Docker, guides are run using the fake executor. Scripts that
+	// require a real container runtime (for example to create networks)
+	// should use the [docker] condition to skip in this case.
+	executor := executorDocker
 	if _, err := exec.LookPath("docker"); err != nil {
-		t.Skip("docker is required to run preguide tests")
+		executor = executorFake
 	}
 
 	selfBuild := buildSelf(t)
@@ -59,17 +73,32 @@ func TestScripts(t *testing.T) {
 		Cmds: map[string]func(ts *testscript.TestScript, neg bool, args []string){
 			"envsubst":            envsubst,
 			"startserver":         startserver,
+			"freeport":            freeport,
 			"createdockernetwork": createdockernetwork,
 			"cmpregex":            cmpregex,
+			"waitfor":             waitfor,
+			"httpget":             httpget,
+			"setenvmatch":         setenvmatch,
+		},
+		Condition: func(cond string) (bool, error) {
+			switch cond {
+			case "docker":
+				return executor == executorDocker, nil
+			}
+			return false, fmt.Errorf("unknown condition %q", cond)
 		},
 		Setup: func(env *testscript.Env) (err error) {
 			defer util.HandleKnown(&err)
 
 			env.Vars = append(env.Vars,
+				"PREGUIDE_EXECUTOR="+executor,
 				"PREGUIDE_IMAGE_OVERRIDE="+os.Getenv("PREGUIDE_IMAGE_OVERRIDE"),
 				"PREGUIDE_PULL_IMAGE=missing",
 				"PREGUIDE_SELF_BUILD="+selfBuild,
 				"PREGUIDE_NO_DEVEL_HASH=true",
+				// Isolate the user cache directory, e.g. the prestep version
+				// cache, for each script
+				"XDG_CACHE_HOME="+filepath.Join(env.WorkDir, ".cache"),
 			)
 
 			// Despite the fact that preguide embeds the definitions it needs,
@@ -177,6 +206,89 @@ func startserver(ts *testscript.TestScript, neg bool, args []string) {
 	ts.Setenv("PRESTEP_SERVER_ADDRESS", serverAddress)
 }
 
+// freeport sets the environment variable named by its argument to a port
+// that is free on localhost
+func freeport(ts *testscript.TestScript, neg bool, args []string) {
+	if neg {
+		ts.Fatalf("freeport cannot be negated")
+	}
+	if len(args) != 1 {
+		ts.Fatalf("usage: freeport NAME")
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	ts.Check(err)
+	port := l.Addr().(*net.TCPAddr).Port
+	ts.Check(l.Close())
+	ts.Setenv(args[0], fmt.Sprint(port))
+}
+
+// waitfor waits for the contents of a file to match a regexp, failing if
+// they do not within 30 seconds. It is used to synchronise with a command
+// running in the background.
+func waitfor(ts *testscript.TestScript, neg bool, args []string) {
+	if neg {
+		ts.Fatalf("waitfor cannot be negated")
+	}
+	if len(args) != 2 {
+		ts.Fatalf("usage: waitfor file regexp")
+	}
+	re, err := regexp.Compile(`(?m)` + args[1])
+	ts.Check(err)
+	fn := ts.MkAbs(args[0])
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		byts, _ := os.ReadFile(fn)
+		if re.Match(byts) {
+			return
+		}
+		if time.Now().After(deadline) {
+			ts.Fatalf("timed out waiting for %v to match %q; contents:\n%s", args[0], args[1], byts)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// httpget writes the body of the response to a GET request for url to file,
+// failing if the response status is not 200 OK
+func httpget(ts *testscript.TestScript, neg bool, args []string) {
+	if neg {
+		ts.Fatalf("httpget cannot be negated")
+	}
+	if len(args) != 2 {
+		ts.Fatalf("usage: httpget url file")
+	}
+	resp, err := http.Get(args[0])
+	ts.Check(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	ts.Check(err)
+	if resp.StatusCode != http.StatusOK {
+		ts.Fatalf("GET %v: %v\n%s", args[0], resp.Status, body)
+	}
+	ts.Check(os.WriteFile(ts.MkAbs(args[1]), body, 0666))
+}
+
+// setenvmatch sets the environment variable NAME to the first submatch of
+// regexp in the contents of file, failing if there is no match
+func setenvmatch(ts *testscript.TestScript, neg bool, args []string) {
+	if neg {
+		ts.Fatalf("setenvmatch cannot be negated")
+	}
+	if len(args) != 3 {
+		ts.Fatalf("usage: setenvmatch NAME file regexp")
+	}
+	re, err := regexp.Compile(`(?m)` + args[2])
+	ts.Check(err)
+	if re.NumSubexp() < 1 {
+		ts.Fatalf("regexp %q has no submatch", args[2])
+	}
+	m := re.FindStringSubmatch(ts.ReadFile(args[1]))
+	if m == nil {
+		ts.Fatalf("no match for %q found in %v", args[2], args[1])
+	}
+	ts.Setenv(args[0], m[1])
+}
+
 func createdockernetwork(ts *testscript.TestScript, neg bool, args []string) {
 	// Create a docker network for the prestep docker test
 	var b bytes.Buffer
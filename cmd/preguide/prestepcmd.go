@@ -0,0 +1,269 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"cuelang.org/go/cue"
+	"cuelang.org/go/cue/errors"
+	"cuelang.org/go/cue/load"
+	"github.com/play-with-go/preguide"
+)
+
+type prestepCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+
+	serveCmd *prestepServeCmd
+}
+
+func newPrestepCmd(r *runner) *prestepCmd {
+	res := &prestepCmd{
+		runner:   r,
+		serveCmd: newPrestepServeCmd(r),
+	}
+	res.flagDefaults = newFlagSet("preguide prestep", func(fs *flag.FlagSet) {
+		res.fs = fs
+	})
+	return res
+}
+
+func (pc *prestepCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide prestep <command>
+
+The commands are:
+
+    serve
+
+%s`[1:], pc.flagDefaults)
+}
+
+func (pc *prestepCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), pc}
+}
+
+func (pc *prestepCmd) run(args []string) error {
+	if err := pc.fs.Parse(args); err != nil {
+		return pc.usageErr("failed to parse flags: %v", err)
+	}
+	args = pc.fs.Args()
+	if len(args) == 0 {
+		return pc.usageErr("missing command")
+	}
+	switch args[0] {
+	case "serve":
+		return pc.serveCmd.run(args[1:])
+	default:
+		return pc.usageErr("unknown command: %v", args[0])
+	}
+}
+
+// prestepServeCmd serves the prestep protocol, as a stand-in for real
+// prestep services. The responses served are described by the
+// #PrestepServeConfig configuration.
+//
+// The endpoint for a prestep package is the server's address followed by the
+// package path, e.g. http://localhost:8080/github.com/play-with-go/gitea.
+// A GET request with get-version=1 to that endpoint returns the configured
+// version. A POST request to a path within that endpoint returns the Vars
+// configured for that path.
+type prestepServeCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+	fConfigs     []string
+	fAddr        *string
+
+	// config is the configuration that results from unifying all the
+	// provided config
+	config prestepServeConfig
+
+	// pkgs are the packages in config, sorted such that the longest path
+	// comes first
+	pkgs []string
+}
+
+// prestepServeConfig corresponds to the #PrestepServeConfig definition
+type prestepServeConfig map[string]*prestepServePackage
+
+type prestepServePackage struct {
+	Version string
+	Paths   map[string]*prestepServeResponse
+}
+
+type prestepServeResponse struct {
+	Vars    []string
+	Secrets []string
+}
+
+func newPrestepServeCmd(r *runner) *prestepServeCmd {
+	res := &prestepServeCmd{
+		runner: r,
+	}
+	res.flagDefaults = newFlagSet("preguide prestep serve", func(fs *flag.FlagSet) {
+		res.fs = fs
+		fs.Var(stringFlagList{&res.fConfigs}, "config", "CUE-format configuration that describes the presteps served. Can appear multiple times. See github.com/play-with-go/preguide.#PrestepServeConfig")
+		res.fAddr = fs.String("addr", "localhost:8080", "the address on which to serve")
+	})
+	return res
+}
+
+func (sc *prestepServeCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide prestep serve [-config file.cue] [-addr address]
+
+%s`[1:], sc.flagDefaults)
+}
+
+func (sc *prestepServeCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), sc}
+}
+
+func (sc *prestepServeCmd) run(args []string) error {
+	if err := sc.fs.Parse(args); err != nil {
+		return sc.usageErr("failed to parse flags: %v", err)
+	}
+	if len(sc.fs.Args()) > 0 {
+		return sc.usageErr("unexpected arguments: %v", sc.fs.Args())
+	}
+	if len(sc.fConfigs) == 0 {
+		return sc.usageErr("at least one -config must be provided")
+	}
+	var err error
+	sc.schemas, err = preguide.LoadSchemas(sc.context)
+	check(err, "failed to load schemas: %v", err)
+	sc.loadConfig()
+
+	l, err := net.Listen("tcp", *sc.fAddr)
+	check(err, "failed to listen on %v: %v", *sc.fAddr, err)
+	fmt.Printf("serving presteps on http://%v\n", l.Addr())
+
+	srv := &http.Server{Handler: sc}
+	done := make(chan struct{})
+	go func() {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt)
+		<-sigint
+		srv.Shutdown(context.Background())
+		close(done)
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		raise("failed to serve: %v", err)
+	}
+	<-done
+	return nil
+}
+
+// loadConfig loads the configuration provided via -config, validating it
+// against the #PrestepServeConfig definition
+func (sc *prestepServeCmd) loadConfig() {
+	var res cue.Value
+	bis := load.Instances(sc.fConfigs, &load.Config{AllCUEFiles: true})
+	for i, bi := range bis {
+		inst := sc.context.BuildInstance(bi)
+		err := inst.Err()
+		check(err, "failed to load config from %v: %v", sc.fConfigs[i], err)
+		res = res.Unify(inst.Value())
+	}
+	res = sc.schemas.PrestepServeConfig.Unify(res)
+	if err := res.Validate(cue.Concrete(true)); err != nil {
+		var errstr strings.Builder
+		errors.Print(&errstr, err, nil)
+		raise("config does not satisfy github.com/play-with-go/preguide.#PrestepServeConfig: %v", errstr.String())
+	}
+	err := res.Decode(&sc.config)
+	check(err, "failed to decode config from CUE value: %v", err)
+
+	for pkg := range sc.config {
+		sc.pkgs = append(sc.pkgs, pkg)
+	}
+	sort.Slice(sc.pkgs, func(i, j int) bool {
+		return len(sc.pkgs[i]) > len(sc.pkgs[j])
+	})
+}
+
+func (sc *prestepServeCmd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var pkg, p string
+	for _, pkg = range sc.pkgs {
+		if r.URL.Path == "/"+pkg {
+			p = "/"
+			break
+		}
+		if strings.HasPrefix(r.URL.Path, "/"+pkg+"/") {
+			p = path.Clean(strings.TrimPrefix(r.URL.Path, "/"+pkg))
+			break
+		}
+	}
+	if p == "" {
+		http.Error(w, fmt.Sprintf("no prestep configured for %v", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	conf := sc.config[pkg]
+	switch r.Method {
+	case "GET":
+		if r.URL.Query().Get("get-version") != "1" || p != "/" {
+			http.Error(w, "only get-version=1 requests are supported", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, conf.Version)
+	case "POST":
+		resp, ok := conf.Paths[p]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no path %v configured for prestep %v", p, pkg), http.StatusNotFound)
+			return
+		}
+		out, err := resp.execute(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("prestep %v (path %v): %v", pkg, p, err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported method %v", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// execute returns the response to a request for a prestep path, the
+// configured response for which is resp. Each of the Vars of resp is a
+// text/template that is executed with the arguments in body as data.
+func (resp *prestepServeResponse) execute(body io.Reader) (*preguide.PrestepOut, error) {
+	var args interface{}
+	if err := json.NewDecoder(body).Decode(&args); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to decode args: %v", err)
+	}
+	res := &preguide.PrestepOut{
+		Vars:    []string{},
+		Secrets: append([]string{}, resp.Secrets...),
+	}
+	for i, v := range resp.Vars {
+		t, err := template.New("var").Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse Vars element %d: %v", i, err)
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, args); err != nil {
+			return nil, fmt.Errorf("failed to execute Vars element %d: %v", i, err)
+		}
+		res.Vars = append(res.Vars, b.String())
+	}
+	return res, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/play-with-go/preguide"
+)
+
+// prestepsCmd lists the version of each configured prestep, resolved as gen
+// would resolve it. The flags of prestepsCmd are therefore a subset of those
+// of genCmd, and set the corresponding fields of genCmd.
+type prestepsCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+}
+
+func newPrestepsCmd(r *runner) *prestepsCmd {
+	res := &prestepsCmd{
+		runner: r,
+	}
+	gc := r.genCmd
+	res.flagDefaults = newFlagSet("preguide presteps", func(fs *flag.FlagSet) {
+		res.fs = fs
+		fs.Var(stringFlagList{&gc.fConfigs}, "config", "CUE-style configuration input; can appear multiple times. See 'cue help inputs'")
+		fs.StringVar(gc.fExecutor, "executor", *gc.fExecutor, fmt.Sprintf("the backend used to run containers. Valid values are: %v, %v, %v", executorDocker, executorPodman, executorLocal))
+		fs.BoolVar(gc.fRefreshPresteps, "refresh-presteps", false, "request the version of each prestep from its endpoint, rather than using any cached version")
+		fs.DurationVar(gc.fPrestepVersionTTL, "prestep-version-ttl", *gc.fPrestepVersionTTL, "the time for which the version of a prestep, once requested from its endpoint, is cached. A value of 0 disables the cache. Use -refresh-presteps to request a version regardless of the cache")
+	})
+	return res
+}
+
+func (pc *prestepsCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide presteps
+
+%s`[1:], pc.flagDefaults)
+}
+
+func (pc *prestepsCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), pc}
+}
+
+func (pc *prestepsCmd) run(args []string) error {
+	if err := pc.fs.Parse(args); err != nil {
+		return pc.usageErr("failed to parse flags: %v", err)
+	}
+	if len(pc.fs.Args()) > 0 {
+		return pc.usageErr("unexpected arguments: %v", pc.fs.Args())
+	}
+	gc := pc.genCmd
+	var err error
+	gc.executor, err = newExecutor(*gc.fExecutor)
+	if err != nil {
+		return pc.usageErr("invalid value for -executor: %v", err)
+	}
+	gc.schemas, err = preguide.LoadSchemas(gc.context)
+	check(err, "failed to load schemas: %v", err)
+	gc.loadConfig()
+
+	var pkgs []string
+	for pkg := range gc.config {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "PACKAGE\tENDPOINT\tVERSION\tFETCHED\n")
+	for _, pkg := range pkgs {
+		e := gc.resolveVersion(pkg, gc.config[pkg])
+		fetched := "-"
+		if !e.Fetched.IsZero() {
+			fetched = e.Fetched.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", e.Package, e.Endpoint, e.Version, fetched)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/play-with-go/preguide"
+)
+
+// prestepRequest performs an HTTP request to a prestep endpoint, returning
+// the response body. The timeout, retries and headers for the request are
+// those of conf. A connection error (including a timeout) or a 5xx status
+// code results in the request being retried, if conf allows. Any other
+// non-2xx status code is an error.
+func prestepRequest(conf *preguide.ServiceConfig, method, url string, body []byte) ([]byte, error) {
+	client := &http.Client{Timeout: conf.Timeout}
+	backoff := conf.Backoff
+	for retry := 0; ; retry++ {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, url, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build HTTP request for method %v, url %q: %v", method, url, err)
+		}
+		for k, v := range conf.Headers {
+			req.Header.Set(k, v)
+		}
+		if conf.BearerTokenEnv != "" {
+			token, ok := os.LookupEnv(conf.BearerTokenEnv)
+			if !ok {
+				return nil, fmt.Errorf("environment variable %v (specified by BearerTokenEnv) is not set", conf.BearerTokenEnv)
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		respBody, err := doPrestepRequest(client, req)
+		if err == nil {
+			return respBody, nil
+		}
+		if _, ok := err.(retryableErr); !ok || retry == conf.Retries {
+			if retry > 0 {
+				err = fmt.Errorf("%v (after %d retries)", err, retry)
+			}
+			return nil, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// retryableErr is the error that results from a request that can be retried
+type retryableErr struct {
+	error
+}
+
+func doPrestepRequest(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, retryableErr{fmt.Errorf("failed to perform HTTP request: %v", err)}
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, retryableErr{fmt.Errorf("failed to read response body: %v", err)}
+	}
+	switch resp.StatusCode / 100 {
+	case 2:
+		return respBody, nil
+	case 5:
+		return nil, retryableErr{fmt.Errorf("got non-success status code (%v)", resp.StatusCode)}
+	}
+	return nil, fmt.Errorf("got non-success status code (%v)", resp.StatusCode)
+}
+
+// execPrestep runs the program of an exec scheme endpoint with args, writing
+// stdin to its standard input and returning its standard output. The program
+// runs with the environment of preguide, plus any variables in conf.Env. It
+// is killed if it does not complete within conf.Timeout (if set).
+func execPrestep(conf *preguide.ServiceConfig, stdin []byte, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, conf.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, execPrestepPath(conf.Endpoint), args...)
+	cmd.Env = os.Environ()
+	for _, e := range conf.Env {
+		if !strings.Contains(e, "=") {
+			// Like a container, a NAME without a value passes through the
+			// value from our environment, which is already the case
+			continue
+		}
+		cmd.Env = append(cmd.Env, e)
+	}
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %v", conf.Timeout)
+		}
+		return nil, fmt.Errorf("failed to run [%v]: %v\n%s", cmd, err, stderr.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// execPrestepPath returns the path to the program of the exec scheme
+// endpoint u. The path can be absolute, as in exec:///path/to/program (or
+// exec:/path/to/program), or relative to the current directory, as in
+// exec:path/to/program.
+func execPrestepPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Path
+}
@@ -78,9 +78,14 @@ Usage of preguide:
 
 The commands are:
 
+    cache
     docker
     gen
     init
+    prestep
+    presteps
+    serve
+    vet
 
 Use "preguide help <command>" for more information about a command.
 
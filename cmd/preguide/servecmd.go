@@ -0,0 +1,299 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/play-with-go/preguide"
+	"github.com/play-with-go/preguide/internal/types"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/renderer/html"
+	"gopkg.in/yaml.v2"
+)
+
+// serveCmd serves a preview of guides as HTML. The guides are generated as
+// by gen -watch, in Jekyll mode, to a temporary output directory. Each
+// markdown file written to that directory by writeGuideOutput is then
+// rendered to HTML on request. Raw HTML in the markdown is passed through as
+// is, such that the data-command-src and data-upload-src blocks of command
+// and upload steps are included in the page. A page reloads itself once a
+// regeneration of the guides finishes.
+//
+// The flags of serveCmd are a subset of those of genCmd, and set the
+// corresponding fields of genCmd.
+type serveCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+	fAddr        *string
+
+	// outDir is the directory to which guides are generated
+	outDir string
+
+	// generation counts the number of times processing of the guides has
+	// finished. Pages poll the generation in order to know when to reload.
+	generation int64
+
+	markdown goldmark.Markdown
+}
+
+func newServeCmd(r *runner) *serveCmd {
+	res := &serveCmd{
+		runner: r,
+	}
+	gc := r.genCmd
+	res.flagDefaults = newFlagSet("preguide serve", func(fs *flag.FlagSet) {
+		res.fs = fs
+		res.fAddr = fs.String("addr", "localhost:8080", "the address on which to serve guides")
+		fs.Var(stringFlagList{&gc.fConfigs}, "config", "CUE-style configuration input; can appear multiple times. See 'cue help inputs'")
+		fs.StringVar(gc.fDir, "dir", "", "the directory within which to run preguide")
+		fs.StringVar(gc.fExecutor, "executor", *gc.fExecutor, fmt.Sprintf("the backend used to run containers. Valid values are: %v, %v, %v", executorDocker, executorPodman, executorLocal))
+		fs.StringVar(gc.fImageOverride, "image", *gc.fImageOverride, "the image to use instead of the guide-specified image")
+		fs.StringVar(gc.fRun, "run", *gc.fRun, "regexp that describes which guides within dir to serve")
+		fs.Var(stringFlagList{&gc.fTags}, "t", "tags for the CUE load")
+		fs.DurationVar(gc.fWatchInterval, "watch-interval", *gc.fWatchInterval, "the interval at which guides are checked for changes")
+	})
+	return res
+}
+
+func (sc *serveCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide serve [-dir dir | dir...]
+
+%s`[1:], sc.flagDefaults)
+}
+
+func (sc *serveCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), sc}
+}
+
+func (sc *serveCmd) run(args []string) error {
+	if err := sc.fs.Parse(args); err != nil {
+		return sc.usageErr("failed to parse flags: %v", err)
+	}
+	gc := sc.genCmd
+	dirArgs := sc.fs.Args()
+	if *gc.fDir != "" && len(dirArgs) > 0 {
+		return sc.usageErr("-dir and args are mutually exclusive")
+	}
+	var err error
+	gc.executor, err = newExecutor(*gc.fExecutor)
+	if err != nil {
+		return sc.usageErr("invalid value for -executor: %v", err)
+	}
+	runRegex, err := regexp.Compile(*gc.fRun)
+	check(err, "failed to compile -run regex %q: %v", *gc.fRun, err)
+
+	// Pages are rendered from Jekyll mode output, because that is the mode
+	// in which command and upload steps carry their sources
+	gc.fMode = types.ModeJekyll
+	parallel := runtime.GOMAXPROCS(0)
+	gc.fParallel = &parallel
+
+	gc.schemas, err = preguide.LoadSchemas(gc.context)
+	check(err, "failed to load schemas: %v", err)
+	gc.loadConfig()
+
+	sc.outDir, err = os.MkdirTemp("", "preguide-serve-")
+	check(err, "failed to create output directory: %v", err)
+	defer os.RemoveAll(sc.outDir)
+	*gc.fOutput = sc.outDir
+
+	sc.markdown = goldmark.New(goldmark.WithRendererOptions(html.WithUnsafe()))
+
+	// Listen before generating the guides, so that an invalid -addr is
+	// reported straight away
+	l, err := net.Listen("tcp", *sc.fAddr)
+	check(err, "failed to listen on %v: %v", *sc.fAddr, err)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", sc.serveHTTP)
+	mux.HandleFunc("/_preguide/generation", sc.serveGeneration)
+	srv := &http.Server{Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(l)
+	}()
+	fmt.Printf("serving guides on http://%v/\n", l.Addr())
+
+	err = gc.watch(dirArgs, runRegex, len(dirArgs) > 0, false, func() {
+		atomic.AddInt64(&sc.generation, 1)
+	})
+	srv.Shutdown(context.Background())
+	if serr := <-serveErr; serr != http.ErrServerClosed {
+		raise("failed to serve guides: %v", serr)
+	}
+	return err
+}
+
+// serveGeneration writes the current generation, for pages to poll
+func (sc *serveCmd) serveGeneration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "%v", atomic.LoadInt64(&sc.generation))
+}
+
+// serveHTTP serves an index of the generated guides at /, and the page for
+// the generated file with basename name at /name
+func (sc *serveCmd) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	// Load the generation before reading any output, such that a page never
+	// claims to be more up to date than it is
+	generation := atomic.LoadInt64(&sc.generation)
+	files, err := sc.outputFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := servePage{
+		Generation: generation,
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if name == "" {
+		p.Title = "Guides"
+		p.Index = true
+		p.Files = files
+	} else {
+		fn, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		p.Title, p.Body, err = sc.render(fn)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p.Title == "" {
+			p.Title = name
+		}
+	}
+	var b bytes.Buffer
+	if err := servePageTemplate.Execute(&b, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b.Bytes())
+}
+
+// outputFiles returns the markdown files in the output directory, keyed by
+// their basename without extension
+func (sc *serveCmd) outputFiles() (map[string]string, error) {
+	es, err := os.ReadDir(sc.outDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output directory: %v", err)
+	}
+	res := make(map[string]string)
+	for _, e := range es {
+		if ext, ok := isMarkdown(e.Name()); ok && e.Type().IsRegular() {
+			res[strings.TrimSuffix(e.Name(), ext)] = filepath.Join(sc.outDir, e.Name())
+		}
+	}
+	return res, nil
+}
+
+// render renders the markdown file fn to HTML, returning the title from its
+// front matter (if any) and the rendered content
+func (sc *serveCmd) render(fn string) (title string, body template.HTML, err error) {
+	byts, err := os.ReadFile(fn)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read %v: %v", filepath.Base(fn), err)
+	}
+	// Jekyll mode output starts with YAML front matter, if the markdown
+	// input to the guide has front matter
+	if rest := bytes.TrimPrefix(byts, []byte("---\n")); len(rest) < len(byts) {
+		if i := bytes.Index(rest, []byte("---\n")); i != -1 {
+			var front struct {
+				Title string `yaml:"title"`
+			}
+			if err := yaml.Unmarshal(rest[:i], &front); err != nil {
+				return "", "", fmt.Errorf("failed to parse front matter of %v: %v", filepath.Base(fn), err)
+			}
+			title = front.Title
+			byts = rest[i+len("---\n"):]
+		}
+	}
+	var b bytes.Buffer
+	if err := sc.markdown.Convert(byts, &b); err != nil {
+		return "", "", fmt.Errorf("failed to render %v: %v", filepath.Base(fn), err)
+	}
+	return title, template.HTML(b.String()), nil
+}
+
+// servePage is the data used to execute servePageTemplate
+type servePage struct {
+	Title      string
+	Generation int64
+
+	// Index is set for the index page, with Files the generated files keyed
+	// by name
+	Index bool
+	Files map[string]string
+
+	// Body is the rendered content of a generated file
+	Body template.HTML
+}
+
+// Names returns the sorted names of p.Files
+func (p servePage) Names() []string {
+	var res []string
+	for n := range p.Files {
+		res = append(res, n)
+	}
+	sort.Strings(res)
+	return res
+}
+
+var servePageTemplate = template.Must(template.New("page").Parse(`
+<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body>
+{{- if .Index}}
+<h1>{{.Title}}</h1>
+<ul>
+{{- range .Names}}
+<li><a href="/{{.}}">{{.}}</a></li>
+{{- else}}
+<li>No guides have been generated</li>
+{{- end}}
+</ul>
+{{- else}}
+{{.Body}}
+{{- end}}
+<script>
+(function() {
+	var generation = {{.Generation}};
+	setInterval(function() {
+		fetch("/_preguide/generation").then(function(resp) {
+			return resp.text();
+		}).then(function(g) {
+			if (Number(g) !== generation) {
+				location.reload();
+			}
+		}).catch(function() {});
+	}, 500);
+})();
+</script>
+</body>
+</html>
+`[1:]))
@@ -15,6 +15,7 @@ import (
 	"regexp"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/play-with-go/preguide/internal/types"
 	"mvdan.cc/sh/v3/syntax"
@@ -71,6 +72,11 @@ type step interface {
 	renderLog(types.Mode, io.Writer)
 	setOutputFrom(step)
 	mustBeReferenced() bool
+
+	// hash returns the hash of the inputs to the run up to and including
+	// the step, as set by setHash. See buildBashFile.
+	hash() string
+	setHash(string)
 }
 
 type renderOptions struct {
@@ -85,6 +91,7 @@ type commandStep struct {
 	Name            string
 	Order           int
 	Terminal        string
+	Hash            string
 
 	Stmts []*commandStmt
 }
@@ -110,6 +117,14 @@ func (c *commandStep) setorder(i int) {
 	c.Order = i
 }
 
+func (c *commandStep) hash() string {
+	return c.Hash
+}
+
+func (c *commandStep) setHash(h string) {
+	c.Hash = h
+}
+
 type commandStmt struct {
 	Negated           *bool
 	CmdStr            string
@@ -117,10 +132,59 @@ type commandStmt struct {
 	Output            string
 	RandomReplace     *string
 	DoNotTrim         *bool
+	Stdin             *string
+	Blocking          *bool
+	Background        *bool
+	Interrupt         *bool
 	outputFence       string
 	sanitisers        []*sanitiser
 	comparators       []*pattern
 	unstableLineOrder *bool
+	waitFor           *string
+	showStdin         *bool
+	exitCode          *types.ExitCode
+	timeout           *time.Duration
+}
+
+// isBlocking reports whether c is a blocking statement
+func (c *commandStmt) isBlocking() bool {
+	return c.Blocking != nil && *c.Blocking
+}
+
+// isBackground reports whether c is run in the background
+func (c *commandStmt) isBackground() bool {
+	return c.Background != nil && *c.Background
+}
+
+// isInterrupt reports whether c is an interrupt statement
+func (c *commandStmt) isInterrupt() bool {
+	return c.Interrupt != nil && *c.Interrupt
+}
+
+// displayStdin returns the input to c as it should be rendered, or the
+// empty string if it should not be rendered
+func (c *commandStmt) displayStdin() string {
+	if c.Stdin == nil || c.showStdin == nil || !*c.showStdin {
+		return ""
+	}
+	return withTrailingNewline(*c.Stdin)
+}
+
+// withTrailingNewline returns s with a trailing newline, adding one if
+// necessary
+func withTrailingNewline(s string) string {
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
+}
+
+// displayCmd returns the command for c as it would be entered by a user
+func (c *commandStmt) displayCmd() string {
+	if c.isBackground() {
+		return c.CmdStr + " &"
+	}
+	return c.CmdStr
 }
 
 type sanitiser struct {
@@ -192,6 +256,9 @@ func (pdc *processDirContext) commandStepFromCommand(c *types.Command) (*command
 					if v.Cmd != nil {
 						return nil, fmt.Errorf("found Path for command source, but Cmd value in Stmts list has Cmd set")
 					}
+					if v.Interrupt != nil && *v.Interrupt {
+						return nil, fmt.Errorf("found Path for command source, but interrupt statement in Stmts list")
+					}
 				default:
 					panic("not possible")
 				}
@@ -258,12 +325,35 @@ func (pdc *processDirContext) commandStepFromCommand(c *types.Command) (*command
 			case types.StmtsListElemString:
 				source = string(csle)
 			case types.Stmt:
+				if csle.Interrupt != nil && *csle.Interrupt {
+					if err := validateInterrupt(csle); err != nil {
+						return nil, fmt.Errorf("bad interrupt statement for Stmts element %d: %v", i, err)
+					}
+					res.Stmts = append(res.Stmts, &commandStmt{Interrupt: csle.Interrupt})
+					continue
+				}
+				if csle.Cmd == nil {
+					return nil, fmt.Errorf("Stmts element %d does not specify Cmd", i)
+				}
 				source = *csle.Cmd
 				cmdStmt.RandomReplace = csle.RandomReplace
 				cmdStmt.DoNotTrim = csle.DoNotTrim
 				cmdStmt.unstableLineOrder = csle.UnstableLineOrder
 				cmdStmt.sanitisers = buildSanitisers(csle.Sanitisers)
 				cmdStmt.comparators = buildComparators(csle.Comparators)
+				cmdStmt.Stdin = csle.Stdin
+				cmdStmt.showStdin = csle.ShowStdin
+				cmdStmt.exitCode = csle.ExitCode
+				if csle.Timeout != nil {
+					d, err := time.ParseDuration(*csle.Timeout)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse Timeout %q for Stmts element %d: %v", *csle.Timeout, i, err)
+					}
+					cmdStmt.timeout = &d
+				}
+				cmdStmt.Blocking = csle.Blocking
+				cmdStmt.Background = csle.Background
+				cmdStmt.waitFor = csle.WaitFor
 			default:
 				panic("not possible")
 			}
@@ -282,11 +372,46 @@ func (pdc *processDirContext) commandStepFromCommand(c *types.Command) (*command
 		if err := pdc.commandStmtFromStmt(stmt, cmdStmt); err != nil {
 			return nil, fmt.Errorf("failed to build command statement for Stmts element %d: %v", i, err)
 		}
+		if err := validateCommandStmt(cmdStmt); err != nil {
+			return nil, fmt.Errorf("bad command statement for Stmts element %d: %v", i, err)
+		}
 		res.Stmts = append(res.Stmts, cmdStmt)
 	}
 	return res, nil
 }
 
+// validateInterrupt ensures that the interrupt statement s does not specify
+// anything other than Interrupt
+func validateInterrupt(s types.Stmt) error {
+	if s.Cmd != nil || s.RandomReplace != nil || s.DoNotTrim != nil ||
+		len(s.Sanitisers) > 0 || len(s.Comparators) > 0 || s.UnstableLineOrder != nil ||
+		s.Stdin != nil || s.ShowStdin != nil || s.ExitCode != nil || s.Timeout != nil ||
+		s.Blocking != nil || s.Background != nil || s.WaitFor != nil {
+		return fmt.Errorf("an interrupt statement cannot specify other fields")
+	}
+	return nil
+}
+
+// validateCommandStmt ensures that the settings of c are consistent
+func validateCommandStmt(c *commandStmt) error {
+	if c.exitCode != nil && c.Negated != nil && *c.Negated {
+		return fmt.Errorf("a negated statement cannot specify ExitCode")
+	}
+	if c.isBlocking() && c.isBackground() {
+		return fmt.Errorf("a statement cannot be both blocking and run in the background")
+	}
+	if !c.isBlocking() && !c.isBackground() {
+		if c.waitFor != nil {
+			return fmt.Errorf("WaitFor can only be specified for a blocking or background statement")
+		}
+		return nil
+	}
+	if c.Negated != nil && *c.Negated {
+		return fmt.Errorf("a blocking or background statement cannot be negated")
+	}
+	return nil
+}
+
 func (pdc *processDirContext) commandStmtFromStmt(stmt *syntax.Stmt, cmdStmt *commandStmt) error {
 	// Capture whether this statement is negated or not
 	negated := stmt.Negated
@@ -302,6 +427,18 @@ func (pdc *processDirContext) commandStmtFromStmt(stmt *syntax.Stmt, cmdStmt *co
 	if negated {
 		cmdStmt.Negated = &negated
 	}
+	// Similarly, capture whether this statement is run in the background;
+	// the generated bash script takes care of running it as such
+	if stmt.Background {
+		background := true
+		cmdStmt.Background = &background
+		stmt.Background = false
+		sb.Reset()
+		if err := pdc.stmtPrinter.Print(&sb, stmt); err != nil {
+			return fmt.Errorf("failed to print statement: %v", err)
+		}
+		cmdStmt.CmdStr = sb.String()
+	}
 	return nil
 }
 
@@ -311,10 +448,15 @@ func (c *commandStep) render(w io.Writer, opts renderOptions) {
 	if len(c.Stmts) > 0 {
 		var stmt *commandStmt
 		for _, stmt = range c.Stmts {
-			fmt.Fprintf(enc, "%s\n", stmt.CmdStr)
+			if stmt.isInterrupt() {
+				fmt.Fprintf(&cmds, "^C\n")
+				continue
+			}
+			fmt.Fprintf(enc, "%s\n", stmt.displayCmd())
 			// replaceBraces is safe to do here because in all modes we are
 			// outputting <pre><code> blocks
-			fmt.Fprintf(&cmds, "$ %s\n", stmt.CmdStr)
+			fmt.Fprintf(&cmds, "$ %s\n", stmt.displayCmd())
+			fmt.Fprintf(&cmds, "%s", stmt.displayStdin())
 			fmt.Fprintf(&cmds, "%s", stmt.Output)
 		}
 		// Output a trailing newline if the last block of output did not include one
@@ -343,7 +485,12 @@ func (c *commandStep) renderLog(mode types.Mode, w io.Writer) {
 	if len(c.Stmts) > 0 {
 		var stmt *commandStmt
 		for _, stmt = range c.Stmts {
-			fmt.Fprintf(w, "$ %s\n", stmt.CmdStr)
+			if stmt.isInterrupt() {
+				fmt.Fprintf(w, "^C\n")
+				continue
+			}
+			fmt.Fprintf(w, "$ %s\n", stmt.displayCmd())
+			fmt.Fprintf(w, "%s", stmt.displayStdin())
 			fmt.Fprintf(w, "%s", stmt.Output)
 		}
 		// Output a trailing newline if the last block of output did not include one
@@ -383,6 +530,7 @@ type uploadStep struct {
 	Name     string
 	Order    int
 	Terminal string
+	Hash     string
 	Language string
 	Renderer types.Renderer
 
@@ -411,6 +559,14 @@ func (u *uploadStep) setorder(i int) {
 	u.Order = i
 }
 
+func (u *uploadStep) hash() string {
+	return u.Hash
+}
+
+func (u *uploadStep) setHash(h string) {
+	u.Hash = h
+}
+
 func (u *uploadStep) UnmarshalJSON(b []byte) error {
 	type noUnmarshall uploadStep
 	var uv struct {
@@ -516,16 +672,36 @@ func replaceBraces(s string) string {
 	return s
 }
 
+// commentPrefixes maps a language that comment supports to the prefix used
+// for each line of a comment in that language. An empty prefix indicates an
+// HTML comment.
+var commentPrefixes = map[string]string{
+	"go":     "// ",
+	"go.mod": "// ",
+	"cue":    "// ",
+	"sh":     "# ",
+	"bash":   "# ",
+	"txt":    "# ",
+	"toml":   "# ",
+	"yaml":   "# ",
+
+	// sync with markdownFile regex
+	"markdown": "",
+	"md":       "",
+	"mkd":      "",
+	"mkdn":     "",
+	"mdown":    "",
+}
+
 func comment(mode types.Mode, s string, lang string) (res string) {
-	switch lang {
-	case "go", "go.mod", "cue":
-		res = linewiseComment(s, "// ")
-	case "sh", "bash", "txt", "toml", "yaml":
-		res = linewiseComment(s, "# ")
-	case "markdown", "md", "mkd", "mkdn", "mdown": // sync with markdownFile regex
+	prefix, ok := commentPrefixes[lang]
+	switch {
+	case !ok:
+		raise("don't know how to comment language %v", lang)
+	case prefix == "":
 		res = fmt.Sprintf("<!-- %v -->", s)
 	default:
-		raise("don't know how to comment language %v", lang)
+		res = linewiseComment(s, prefix)
 	}
 	if mode == types.ModeJekyll {
 		res = template.HTMLEscapeString(res)
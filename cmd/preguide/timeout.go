@@ -0,0 +1,149 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timedSection is a section of the script for a terminal that is subject to
+// a timeout. A section starts and ends with a line of output that is fence.
+type timedSection struct {
+	// step and stmt identify the statement to which the section
+	// corresponds
+	step string
+	stmt int
+
+	// what describes what the script is doing during the section, for
+	// the purposes of reporting a timeout
+	what string
+
+	fence   string
+	timeout time.Duration
+
+	// file, if set, is the name of the file within the scripts directory
+	// to which the output of the statement is written, as is the case for
+	// blocking and background statements. Otherwise the output of the
+	// statement is that of the section itself.
+	file string
+}
+
+// sectionTimer is an io.Writer that watches the output of the script for a
+// terminal, timing each of its sections in turn. Sections must be given in the
+// order in which their output appears. If a section does not complete within
+// its timeout, expired is called (once) with that section and the output of
+// the statement so far.
+//
+// The output is scanned as it is written. Only the output of the section
+// being timed (where that is the output of its statement) is kept, along with
+// a tail of the output that is long enough to contain the start of a fence
+// that is split across writes.
+type sectionTimer struct {
+	// scriptsDir is the host path of the scripts directory
+	scriptsDir string
+
+	expired func(s *timedSection, output string)
+
+	mu       sync.Mutex
+	sections []*timedSection
+
+	// out is the output that has been kept, and pos is the position in out
+	// from which we are looking for the next fence
+	out []byte
+	pos int
+
+	// current is the section being timed, if any. When set, and the output
+	// of its statement is that of the section, out starts with the output
+	// of the section.
+	current *timedSection
+	timer   *time.Timer
+
+	stopped bool
+}
+
+func newSectionTimer(scriptsDir string, sections []*timedSection, expired func(s *timedSection, output string)) *sectionTimer {
+	return &sectionTimer{
+		scriptsDir: scriptsDir,
+		sections:   sections,
+		expired:    expired,
+	}
+}
+
+func (st *sectionTimer) Write(b []byte) (int, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.stopped || len(st.sections) == 0 {
+		return len(b), nil
+	}
+	st.out = append(st.out, b...)
+	for !st.stopped && len(st.sections) > 0 {
+		s := st.sections[0]
+		fence := []byte(s.fence + "\r\n")
+		i := bytes.Index(st.out[st.pos:], fence)
+		if i == -1 {
+			break
+		}
+		st.pos += i + len(fence)
+		if st.current == nil {
+			st.current = s
+			st.discard(st.pos)
+			st.timer = time.AfterFunc(s.timeout, func() { st.expire(s) })
+			continue
+		}
+		st.timer.Stop()
+		st.current = nil
+		st.sections = st.sections[1:]
+	}
+	if len(st.sections) == 0 {
+		st.out, st.pos = nil, 0
+		return len(b), nil
+	}
+	// The next fence has not been written in full, hence if it has been
+	// started it starts within its length (less one) of the end of out
+	if tail := len(st.out) - (len(st.sections[0].fence+"\r\n") - 1); tail > st.pos {
+		st.pos = tail
+	}
+	if st.current == nil || st.current.file != "" {
+		st.discard(st.pos)
+	}
+	return len(b), nil
+}
+
+// discard discards the first n bytes of the output that has been kept
+func (st *sectionTimer) discard(n int) {
+	st.out = append(st.out[:0], st.out[n:]...)
+	st.pos -= n
+}
+
+func (st *sectionTimer) expire(s *timedSection) {
+	st.mu.Lock()
+	if st.stopped || st.current != s {
+		st.mu.Unlock()
+		return
+	}
+	st.stopped = true
+	output := string(st.out)
+	st.mu.Unlock()
+	if s.file != "" {
+		b, _ := os.ReadFile(filepath.Join(st.scriptsDir, s.file))
+		output = string(b)
+	}
+	st.expired(s, strings.ReplaceAll(output, "\r\n", "\n"))
+}
+
+// stop stops any running timer
+func (st *sectionTimer) stop() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.stopped = true
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/play-with-go/preguide"
+)
+
+// The version of a prestep is requested from its endpoint for every run of
+// gen, even when the output of every guide turns out to be cached. So that a
+// gen run that has nothing to do does not need to make those requests, the
+// versions are cached on disk for -prestep-version-ttl. An entry in the
+// version cache is keyed by the prestep package and its endpoint, such that a
+// change of endpoint for a package results in a cache miss. A new version
+// served by the same endpoint is not seen until the entry expires, unless
+// -refresh-presteps is used to request the version regardless of the cache.
+
+// versionCacheEntry is the record of the version of a prestep package
+// resolved from its endpoint
+type versionCacheEntry struct {
+	Package  string
+	Endpoint string
+	Version  string
+
+	// Fetched is the time at which Version was requested from Endpoint. The
+	// zero value indicates a version that is not cached.
+	Fetched time.Time
+}
+
+// cacheDir returns the directory used by preguide for caching, within the
+// user cache directory
+func cacheDir() string {
+	d, err := os.UserCacheDir()
+	check(err, "failed to determine user cache directory: %v", err)
+	return filepath.Join(d, "preguide")
+}
+
+// versionCacheFile returns the path of the file within the version cache for
+// the prestep package pkg, served by conf
+func versionCacheFile(pkg string, conf *preguide.ServiceConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v\n%v", pkg, conf.Endpoint)
+	return filepath.Join(cacheDir(), "prestep-versions", fmt.Sprintf("%x.json", h.Sum(nil)))
+}
+
+// useVersionCache determines whether the version cache should be used for
+// the prestep served by conf. The version of a file scheme endpoint does not
+// require a request. When recording or replaying prestep requests, the
+// request for the version is significant.
+func (gc *genCmd) useVersionCache(conf *preguide.ServiceConfig) bool {
+	return *gc.fPrestepVersionTTL > 0 &&
+		conf.Endpoint.Scheme != "file" &&
+		*gc.fPrestepRecord == "" &&
+		*gc.fPrestepReplay == ""
+}
+
+// resolveVersion resolves the version of the prestep package pkg, served
+// by conf. The version cache is used unless it has expired or -refresh-presteps
+// is specified, in which case the version is requested from the endpoint and
+// the cache updated.
+func (gc *genCmd) resolveVersion(pkg string, conf *preguide.ServiceConfig) *versionCacheEntry {
+	if !gc.useVersionCache(conf) {
+		return &versionCacheEntry{
+			Package:  pkg,
+			Endpoint: conf.Endpoint.String(),
+			Version:  gc.fetchVersion(pkg, conf),
+		}
+	}
+	fn := versionCacheFile(pkg, conf)
+	if !*gc.fRefreshPresteps {
+		if e := readVersionCacheEntry(fn); e != nil && time.Since(e.Fetched) < *gc.fPrestepVersionTTL {
+			gc.debugf("using version %q of prestep %v cached at %v\n", e.Version, pkg, e.Fetched)
+			return e
+		}
+	}
+	e := &versionCacheEntry{
+		Package:  pkg,
+		Endpoint: conf.Endpoint.String(),
+		Version:  gc.fetchVersion(pkg, conf),
+		Fetched:  time.Now(),
+	}
+	writeVersionCacheEntry(fn, e)
+	return e
+}
+
+// readVersionCacheEntry reads the version cache entry in fn. It returns nil
+// if there is no such entry. A corrupt entry is also treated as missing,
+// because it will be replaced once the version has been requested.
+func readVersionCacheEntry(fn string) *versionCacheEntry {
+	byts, err := os.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	check(err, "failed to read prestep version cache entry %v: %v", fn, err)
+	var e versionCacheEntry
+	if err := json.Unmarshal(byts, &e); err != nil {
+		return nil
+	}
+	return &e
+}
+
+// writeVersionCacheEntry writes e to fn
+func writeVersionCacheEntry(fn string, e *versionCacheEntry) {
+	byts, err := json.MarshalIndent(e, "", "  ")
+	check(err, "failed to encode prestep version cache entry for %v: %v", e.Package, err)
+	writeCacheFile(fn, byts)
+}
+
+// writeCacheFile writes byts to the file fn within the cache directory.
+// Because multiple runs of preguide can share the cache, byts is written to
+// a temporary file that is then renamed.
+func writeCacheFile(fn string, byts []byte) {
+	dir := filepath.Dir(fn)
+	err := os.MkdirAll(dir, 0777)
+	check(err, "failed to create cache directory %v: %v", dir, err)
+	tf, err := os.CreateTemp(dir, ".tmp-")
+	check(err, "failed to create temp file in %v: %v", dir, err)
+	_, err = tf.Write(append(byts, '\n'))
+	check(err, "failed to write to %v: %v", tf.Name(), err)
+	err = tf.Close()
+	check(err, "failed to close %v: %v", tf.Name(), err)
+	err = os.Rename(tf.Name(), fn)
+	check(err, "failed to rename %v to %v: %v", tf.Name(), fn, err)
+}
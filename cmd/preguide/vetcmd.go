@@ -0,0 +1,270 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"text/template/parse"
+
+	"github.com/play-with-go/preguide"
+	"github.com/play-with-go/preguide/internal/types"
+	"github.com/play-with-go/preguide/internal/util"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// vetCmd statically validates guides, without running any steps, presteps or
+// containers. It performs the first phase of gen (processDirPre) for each
+// guide: validation of the guide's CUE package against the #Guide schema,
+// parsing of the directives in its markdown files, and the checking of step
+// and ref directives. vetCmd then adds checks for errors that gen otherwise
+// only reports once the steps of a guide are run, including the resolution
+// of outref directives.
+//
+// The flags of vetCmd are a subset of those of genCmd, and set the
+// corresponding fields of genCmd.
+type vetCmd struct {
+	*runner
+	fs           *flag.FlagSet
+	flagDefaults string
+}
+
+func newVetCmd(r *runner) *vetCmd {
+	res := &vetCmd{
+		runner: r,
+	}
+	gc := r.genCmd
+	res.flagDefaults = newFlagSet("preguide vet", func(fs *flag.FlagSet) {
+		res.fs = fs
+		fs.StringVar(gc.fDir, "dir", "", "the directory within which to run preguide")
+		fs.StringVar(gc.fRun, "run", *gc.fRun, "regexp that describes which guides within dir to validate")
+		fs.Var(&gc.fMode, "mode", fmt.Sprintf("the output mode. Valid values are: %v, %v, %v", types.ModeJekyll, types.ModeGitHub, types.ModeRaw))
+		fs.Var(stringFlagList{&gc.fTags}, "t", "tags for the CUE load")
+	})
+	return res
+}
+
+func (vc *vetCmd) usage() string {
+	return fmt.Sprintf(`
+usage: preguide vet [-dir dir | dir...]
+
+%s`[1:], vc.flagDefaults)
+}
+
+func (vc *vetCmd) usageErr(format string, args ...interface{}) usageErr {
+	return usageErr{fmt.Errorf(format, args...), vc}
+}
+
+func (vc *vetCmd) run(args []string) error {
+	if err := vc.fs.Parse(args); err != nil {
+		return vc.usageErr("failed to parse flags: %v", err)
+	}
+	gc := vc.genCmd
+	dirArgs := vc.fs.Args()
+	if *gc.fDir != "" && len(dirArgs) > 0 {
+		return vc.usageErr("-dir and args are mutually exclusive")
+	}
+	runRegex, err := regexp.Compile(*gc.fRun)
+	check(err, "failed to compile -run regex %q: %v", *gc.fRun, err)
+
+	gc.schemas, err = preguide.LoadSchemas(gc.context)
+	check(err, "failed to load schemas: %v", err)
+
+	var errs errList
+	for _, d := range gc.guideDirs(dirArgs, runRegex) {
+		pdc := &processDirContext{
+			genCmd:      gc,
+			stmtPrinter: syntax.NewPrinter(syntax.SingleLine(true)),
+			guideDir:    d,
+		}
+		err := pdc.vetDir(len(dirArgs) > 0)
+		switch err.(type) {
+		case nil:
+		case errList:
+			// We already have position information
+			errs = append(errs, err)
+		default:
+			errs.Addf("%v: %v", pdc.relpath(d), err)
+		}
+	}
+	if err := errs.Err(); err != nil {
+		raise("%v", err)
+	}
+	return nil
+}
+
+// vetDir performs the checks of vet for the guide (if any) in pdc.guideDir
+func (pdc *processDirContext) vetDir(mustContainGuide bool) (err error) {
+	defer util.HandleKnown(&err)
+	if err := pdc.processDirPre(mustContainGuide); err != nil {
+		return err
+	}
+	if pdc.guide == nil {
+		return nil
+	}
+	if err := pdc.vetOutRefs(); err != nil {
+		return err
+	}
+	return pdc.vetSteps()
+}
+
+// vetOutRefs checks that the out reference directives (e.g. {{ outref
+// "cmdoutput" }}) in the guide's markdown files resolve, as gen does once the
+// steps of the guide have run. outref directives resolve against the out
+// package of the guide, hence if the guide has no out package, i.e. it has
+// not yet been run, they are not checked.
+func (pdc *processDirContext) vetOutRefs() error {
+	fi, err := os.Stat(filepath.Join(pdc.guide.dir, outPkg))
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	return pdc.validateOutRefDirs()
+}
+
+// vetSteps checks the steps of each run of the guide for errors that would
+// otherwise only be reported when the steps are run:
+//
+//   - {{.VAR}} references (using the guide's delimiters) to variables that no
+//     prestep of the guide provides.
+//   - the rendering of upload steps, e.g. a line range renderer with ranges
+//     outside the upload source.
+//   - filename comments in a language that is not supported.
+//
+// The variables provided by the presteps of a guide are only known once
+// those presteps have run. Hence references are checked against the
+// variables recorded in the guide's out package for the same presteps. If
+// the guide has presteps but no such record, references are not checked.
+func (pdc *processDirContext) vetSteps() error {
+	g := pdc.guide
+	var errs errList
+	seen := make(map[string]bool)
+	addf := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf("%v: "+format, append([]interface{}{pdc.relpath(g.dir)}, args...)...)
+		if !seen[msg] {
+			seen[msg] = true
+			errs.Addf("%s", msg)
+		}
+	}
+	for _, r := range g.runs {
+		vars, known := pdc.prestepVars(r)
+		checkVars := func(s step, what, text string) {
+			refs, err := templateVars(text, g.Delims)
+			if err != nil {
+				addf("step %q: failed to parse %v: %v", s.name(), what, err)
+				return
+			}
+			if !known {
+				return
+			}
+			for _, ref := range refs {
+				if !vars[ref] {
+					addf("step %q: %v references %v.%v%v, which is not provided by any prestep", s.name(), what, g.Delims[0], ref, g.Delims[1])
+				}
+			}
+		}
+		for _, s := range r.steps {
+			switch s := s.(type) {
+			case *commandStep:
+				for _, stmt := range s.Stmts {
+					checkVars(s, "statement", stmt.CmdStr)
+				}
+			case *uploadStep:
+				checkVars(s, "upload target", s.Target)
+				checkVars(s, "upload source", s.Source)
+				if _, err := s.Renderer.Render(pdc.fMode, s.Source); err != nil {
+					addf("step %q: failed to render upload: %v", s.name(), err)
+				}
+				if g.FilenameComment != nil && *g.FilenameComment {
+					if _, ok := commentPrefixes[s.Language]; !ok {
+						addf("step %q: FilenameComment is not supported for language %q", s.name(), s.Language)
+					}
+				}
+			}
+		}
+	}
+	return errs.Err()
+}
+
+// prestepVars returns the set of variables provided by the presteps of r,
+// as recorded in the guide's out package. known is false if there is no
+// record of the variables provided by those presteps.
+func (pdc *processDirContext) prestepVars(r *guideRun) (vars map[string]bool, known bool) {
+	vars = make(map[string]bool)
+	if len(r.Presteps) == 0 {
+		return vars, true
+	}
+	out := pdc.guide.outputGuide
+	if out == nil {
+		return nil, false
+	}
+	or := out.Outputs[r.scenario.Name][r.lang]
+	if or == nil || len(or.Presteps) != len(r.Presteps) {
+		return nil, false
+	}
+	for i, ps := range r.Presteps {
+		ops := or.Presteps[i]
+		if ops.Package != ps.Package || ops.Path != ps.Path {
+			return nil, false
+		}
+		for _, v := range ops.Variables {
+			vars[v] = true
+		}
+	}
+	return vars, true
+}
+
+// templateVars returns the names of the variables referenced by {{.VAR}}
+// templates in s, where delims are the template delimiters
+func templateVars(s string, delims [2]string) ([]string, error) {
+	trees, err := parse.Parse("vet", s, delims[0], delims[1])
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	var walk func(n parse.Node)
+	walk = func(n parse.Node) {
+		switch n := n.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Nodes {
+				walk(c)
+			}
+		case *parse.ActionNode:
+			walk(n.Pipe)
+		case *parse.PipeNode:
+			if n == nil {
+				return
+			}
+			for _, c := range n.Cmds {
+				walk(c)
+			}
+		case *parse.CommandNode:
+			for _, a := range n.Args {
+				walk(a)
+			}
+		case *parse.FieldNode:
+			res = append(res, n.Ident[0])
+		case *parse.IfNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walk(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		}
+	}
+	walk(trees["vet"].Root)
+	return res, nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The play-with-go.dev Authors. All rights reserved.  Use of
+// this source code is governed by a BSD-style license that can be found in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/play-with-go/preguide/internal/types"
+	"github.com/play-with-go/preguide/internal/util"
+)
+
+// watch implements gen -watch. The inputs of each guide are checked for
+// changes every -watch-interval, and those guides whose inputs have changed
+// are processed again. The inputs of a guide are the files of its CUE
+// package, its markdown files and any files referenced by the Path of a step.
+//
+// The initial check finds every guide to have changed, which means that
+// every guide is processed to start with. Processing a guide is subject to
+// the usual checks against the out package of the guide. Hence a change to
+// the prose of a guide does not result in its steps being run.
+//
+// Errors that result from processing guides are reported, rather than
+// causing watch to fail. If processed is not nil, it is called each time
+// processing finishes, whether or not there were errors. watch returns when
+// interrupted.
+func (gc *genCmd) watch(dirArgs []string, runRegex *regexp.Regexp, mustContainGuide, writeStructures bool, processed func()) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+
+	// stamps maps a guide directory to the stamp of its inputs when it was
+	// last processed
+	stamps := make(map[string]string)
+
+	// guides maps a guide directory to the result of its last successful
+	// processing
+	guides := make(map[string]*guide)
+
+	// stepPaths maps a guide directory to the files referenced by the Path
+	// of a step, as of the last time the guide was processed successfully
+	stepPaths := make(map[string][]string)
+
+	ticker := time.NewTicker(*gc.fWatchInterval)
+	defer ticker.Stop()
+	for {
+		var changed []string
+		dirs := gc.guideDirs(dirArgs, runRegex)
+		seen := make(map[string]bool)
+		for _, d := range dirs {
+			seen[d] = true
+			stamp := watchStamp(d, stepPaths[d])
+			if stamp != stamps[d] {
+				stamps[d] = stamp
+				changed = append(changed, d)
+			}
+		}
+		removed := false
+		for d := range stamps {
+			if !seen[d] {
+				delete(stamps, d)
+				delete(guides, d)
+				delete(stepPaths, d)
+				removed = true
+			}
+		}
+		if len(changed) > 0 || removed {
+			gc.watchProcess(changed, mustContainGuide, writeStructures, guides, stepPaths)
+			if processed != nil {
+				processed()
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+// watchProcess processes the guides in dirs for watch, updating guides and
+// stepPaths with the results, and writing the guide structures for all
+// guides if writeStructures is set.
+func (gc *genCmd) watchProcess(dirs []string, mustContainGuide, writeStructures bool, guides map[string]*guide, stepPaths map[string][]string) {
+	defer func() {
+		var err error
+		util.HandleKnown(&err)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+
+	// Presteps might have changed between rounds, so we resolve their
+	// versions afresh (subject to the on-disk version cache)
+	gc.versionsLock.Lock()
+	gc.versions = make(map[string]interface{})
+	gc.versionsLock.Unlock()
+	gc.versionChecksLock.Lock()
+	gc.versionChecks = make(map[string]chan struct{})
+	gc.versionChecksLock.Unlock()
+
+	processed, errs := gc.processGuides(dirs, mustContainGuide)
+	for _, d := range dirs {
+		delete(guides, d)
+	}
+	for _, g := range processed {
+		guides[g.dir] = g
+		stepPaths[g.dir] = g.stepPaths
+		fmt.Printf("%v: generated\n", gc.relpath(g.dir))
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if writeStructures {
+		gc.guides = nil
+		for _, g := range guides {
+			gc.guides = append(gc.guides, g)
+		}
+		sort.Slice(gc.guides, func(i, j int) bool {
+			return gc.guides[i].dir < gc.guides[j].dir
+		})
+		gc.writeGuideStructures()
+	}
+}
+
+// watchStamp returns a stamp of the inputs of the guide in dir, where
+// stepPaths are the files referenced by the Path of a step of that guide.
+// The stamp changes if any input is added, removed or modified.
+func watchStamp(dir string, stepPaths []string) string {
+	var paths []string
+	es, _ := os.ReadDir(dir)
+	for _, e := range es {
+		name := e.Name()
+		if !e.Type().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		// Only consider the markdown files that are input to the guide, as
+		// opposed to any output that is written to the guide directory
+		if ext, ok := isMarkdown(name); ok && types.ValidLangCode(strings.TrimSuffix(name, ext)) || filepath.Ext(name) == ".cue" {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	paths = append(paths, stepPaths...)
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%v\n", p)
+		if fi, err := os.Stat(p); err == nil {
+			fmt.Fprintf(h, "%v %v\n", fi.Size(), fi.ModTime().UnixNano())
+		} else {
+			fmt.Fprintf(h, "missing\n")
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
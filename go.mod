@@ -8,6 +8,7 @@ require (
 	github.com/google/go-cmp v0.5.6
 	github.com/kr/pretty v0.3.0
 	github.com/rogpeppe/go-internal v1.9.0
+	github.com/yuin/goldmark v1.4.12
 	gopkg.in/yaml.v2 v2.4.0
 	honnef.co/go/tools v0.3.3
 	mvdan.cc/sh/v3 v3.5.1
@@ -37,7 +38,9 @@ require (
 	golang.org/x/exp/typeparams v0.0.0-20220218215828-6cf2b201936e // indirect
 	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
 	golang.org/x/net v0.0.0-20211015210444-4f30a5c0130f // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/tools v0.1.11-0.20220513221640-090b14e8501f // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
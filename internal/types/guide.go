@@ -59,6 +59,7 @@ type Guide struct {
 	Defs            map[string]interface{}
 	Networks        []string
 	Env             []string
+	Timeout         *string
 }
 
 type LangCode string
@@ -72,23 +73,45 @@ func ValidLangCode(s string) bool {
 	return false
 }
 
-type Steps map[string]Step
+// Steps maps a step name to the per-language variants of that step
+type Steps map[string]LangSteps
+
+// LangSteps maps a language to the variant of a step for that language. A
+// step that is not overridden per language has a single en variant, which is
+// used for all languages.
+type LangSteps map[LangCode]Step
 
 func (l *Steps) UnmarshalJSON(b []byte) error {
-	var v map[string]json.RawMessage
+	var v map[string]map[string]json.RawMessage
 	if err := json.Unmarshal(b, &v); err != nil {
 		return err
 	}
 	if len(v) > 0 && *l == nil {
-		*l = make(map[string]Step)
+		*l = make(map[string]LangSteps)
 	}
 	for stepName, m := range v {
-		var s Step
-		s, err := unmarshalStep(m)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal Step %q: %v", stepName, err)
+		ls := make(LangSteps)
+		if _, ok := m["StepType"]; ok {
+			// A step without per-language variants
+			b, err := json.Marshal(m)
+			if err != nil {
+				return fmt.Errorf("failed to marshal Step %q: %v", stepName, err)
+			}
+			s, err := unmarshalStep(b)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal Step %q: %v", stepName, err)
+			}
+			ls["en"] = s
+		} else {
+			for lang, sm := range m {
+				s, err := unmarshalStep(sm)
+				if err != nil {
+					return fmt.Errorf("failed to unmarshal Step %q for language %v: %v", stepName, lang, err)
+				}
+				ls[LangCode(lang)] = s
+			}
 		}
-		(*l)[stepName] = s
+		(*l)[stepName] = ls
 	}
 	return nil
 }
@@ -214,6 +237,32 @@ type Stmt struct {
 	Sanitisers        []Sanitiser
 	Comparators       []Pattern
 	UnstableLineOrder *bool
+	Stdin             *string
+	ShowStdin         *bool
+	ExitCode          *ExitCode
+	Timeout           *string
+	Blocking          *bool
+	Background        *bool
+	WaitFor           *string
+	Interrupt         *bool
+}
+
+// ExitCode is the expected exit code of a statement, expressed as a CUE
+// constraint, e.g. 2 or >0 & <3
+type ExitCode string
+
+func (e *ExitCode) UnmarshalJSON(b []byte) error {
+	var i int
+	if err := json.Unmarshal(b, &i); err == nil {
+		*e = ExitCode(fmt.Sprint(i))
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("failed to unmarshal ExitCode; not int or string")
+	}
+	*e = ExitCode(s)
+	return nil
 }
 
 type Sanitiser struct {
@@ -5,13 +5,46 @@ import "github.com/play-with-go/preguide"
 #GuideOutput: {
 	Delims: [string, string]
 	FilenameComment?: bool
-	Presteps: [...#Prestep]
 	Terminals: [...preguide.#Terminal]
 	Scenarios: [...preguide.#Scenario]
-	Hash: string
-	Steps: [string]: #Step
 	Networks: [...string]
 	Env: [...string]
+
+	// Outputs maps a scenario name and language code to the output that
+	// results from running the guide's steps for that scenario and
+	// language.
+	Outputs: [scenario=string]: [lang=string]: #Output
+
+	// Defs are author-defined values that can be referenced from the
+	// guide prose via outref directives. Typically these refer to parts
+	// of the generated output, e.g. the output of a command.
+	Defs: [string]: _
+}
+
+// #Output is the result of running the steps of a guide for a given
+// scenario and language.
+#Output: {
+	Presteps: [...#Prestep]
+	Hash: string
+
+	// HashInputs are the inputs from which Hash was computed, in the order
+	// in which they were hashed. They allow the inputs that changed
+	// between runs to be reported.
+	HashInputs?: [...#HashInput]
+	Steps: [string]: #Step
+
+	// Defs are author-defined values, specific to this output, that can be
+	// referenced from the guide prose via outref directives. They take
+	// precedence over the top-level Defs of #GuideOutput.
+	Defs: [string]: _
+}
+
+// #HashInput is an input to the Hash of an #Output. Key identifies the
+// input, for example the image of a terminal or a statement of a command
+// step. Value is the text of the input that was hashed.
+#HashInput: {
+	Key:   string
+	Value: string
 }
 
 _stepCommon: {
@@ -19,6 +52,11 @@ _stepCommon: {
 	Name:     string
 	Order:    int
 	Terminal: string
+
+	// Hash is the hash of the inputs to the run of the guide up to and
+	// including this step. The Hash of the last step is therefore the Hash
+	// of the #Output. Steps with the same Hash are run in the same state.
+	Hash?: string
 }
 
 // TODO: keep this in sync with the Go definitions
@@ -53,6 +91,10 @@ _stepCommon: {
 	Output:         string
 	DoNotTrim?:     bool
 	RandomReplace?: string
+	Stdin?:         string
+	Blocking?:      bool
+	Background?:    bool
+	Interrupt?:     bool
 }
 
 #UploadStep: {
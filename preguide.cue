@@ -13,8 +13,11 @@ import (
 
 #Guide: {
 
-	Languages: [...#Language]
-	Languages: ["en"]
+	// Languages are the languages in which the guide is written. There
+	// must be a markdown file for each language, e.g. de.markdown. English
+	// is required, because steps that are not overridden for a language
+	// fall back to their English variant.
+	Languages: *["en"] | [...#Language]
 
 	FilenameComment?: bool
 
@@ -28,14 +31,32 @@ import (
 
 	Presteps: [...#Prestep]
 
+	// Timeout is the default timeout for each statement of the guide. See
+	// #Stmt.Timeout
+	Timeout?: #Duration
+
 	// Delims are the delimiters used in the guide prose and steps
 	// for environment variable substitution. A template substitution
 	// of the environment variable ABC therefore looks like "{{ .ABC }}"
 	Delims: *["{{", "}}"] | [string, string]
 
-	Steps: [name=string]: #Step & {
+	// Steps are the steps of the guide. A step can be overridden for a
+	// given language by declaring a variant per language instead, e.g.
+	//
+	//     Steps: step1: en: #Command & {...}
+	//     Steps: step1: de: #Command & {...}
+	//
+	// in which case the en variant is required, and is used for languages
+	// that do not declare a variant.
+	Steps: [name=string]: (#Step & {
 		Name:     name
 		Terminal: _#TerminalName
+	}) | {
+		en: _
+		[#Language]: #Step & {
+			Name:     name
+			Terminal: _#TerminalName
+		}
 	}
 
 	// Scenarios define the various images under which this guide will be
@@ -133,6 +154,61 @@ _stepCommon: {
 	Sanitisers?: [...#Sanitiser]
 	Comparators?: [...#Pattern]
 	UnstableLineOrder?: bool
+
+	// Stdin is the input to Cmd, e.g. the answers to prompts or the input
+	// to a REPL. A trailing newline is added if Stdin does not end with one.
+	Stdin?: string
+
+	// ShowStdin indicates that Stdin should be rendered as if the user
+	// typed it immediately after Cmd
+	ShowStdin?: bool
+
+	// ExitCode is the expected exit code of Cmd, either an exact exit code,
+	// or a CUE constraint (expressed as a string), e.g. ">0 & <3". By
+	// default, Cmd is expected to succeed, or fail if negated with !. An
+	// invalid constraint is an error when the guide is loaded. An ExitCode
+	// cannot be specified for a negated statement.
+	ExitCode?: int | string
+
+	// Timeout is the maximum time Cmd may take to run before the guide
+	// fails. For a Blocking or Background statement, Timeout applies to
+	// waiting for WaitFor to match, and to waiting for its process to exit
+	// once interrupted. If not specified, the guide's Timeout applies, else
+	// the value of the -timeout flag.
+	Timeout?: #Duration
+
+	// Blocking indicates that Cmd is a long-running process, e.g. a server,
+	// that blocks the terminal until it is stopped by an interrupt
+	// statement. The next statement in the same terminal must therefore be
+	// an interrupt statement. The output from Cmd up until the point it is
+	// interrupted is recorded as its output.
+	Blocking?: bool
+
+	// Background indicates that Cmd is run in the background, as if it
+	// were followed by &. Processes run in the background are interrupted
+	// when the script for the terminal completes, at which point their
+	// output is recorded. A trailing & on a statement has the same effect.
+	Background?: bool
+
+	// WaitFor is a regular expression, in the syntax of grep -E, that the
+	// output from a Blocking or Background statement must match before the
+	// script continues. For example, a log message that indicates a server
+	// is ready to accept requests.
+	WaitFor?: string
+
+	// Interrupt indicates that this statement is not a command but rather
+	// the delivery of SIGINT, i.e. Ctrl-C, to the process started by the
+	// Blocking statement that precedes it in the same terminal.
+	Interrupt?: bool
+}
+
+// #Duration is a duration in the format accepted by Go's time.ParseDuration,
+// e.g. "30s" or "2m"
+#Duration: =~"^([0-9]+(\\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$"
+
+// #Interrupt is a convenience definition for an interrupt statement
+#Interrupt: #Stmt & {
+	Interrupt: true
 }
 
 #Sanitiser: {
@@ -172,6 +248,14 @@ _stepCommon: {
 
 // #PrestepConfig is the endpoint configuration for a prestep
 #PrestepConfig: {
+	// Endpoint is the URL of the prestep. In addition to http and https,
+	// two schemes are supported. With the file scheme (file:///path), the
+	// response is read from a file. With the exec scheme (exec:/path or
+	// exec:relative/path), a program is run: the arguments of the prestep
+	// are written as JSON to its stdin, the path of the prestep is passed
+	// as its only argument, and the response is read from its stdout. The
+	// version of an exec scheme prestep is the output of the program when
+	// run with --version as its only argument.
 	Endpoint: string
 
 	// Networks defines the list of docker networks to connect to when
@@ -181,6 +265,60 @@ _stepCommon: {
 	// Env is the environment to pass to docker containers when running
 	// this prestep.
 	Env: [...string]
+
+	// Timeout is the timeout for each request made to the endpoint. By
+	// default there is no timeout.
+	Timeout?: #Duration
+
+	// Retries is the number of times a request to the endpoint is retried
+	// following a connection error (including a timeout) or a 5xx status
+	// code.
+	Retries: *0 | int & >=0
+
+	// Backoff is the time to wait before the first retry of a request. The
+	// time to wait doubles with each subsequent retry.
+	Backoff: *"1s" | #Duration
+
+	// Headers are HTTP headers added to each request made to the endpoint.
+	Headers: [string]: string
+
+	// BearerTokenEnv is the name of an environment variable, the value of
+	// which is sent as a bearer token in the Authorization header of each
+	// request made to the endpoint.
+	BearerTokenEnv?: string
+}
+
+// #PrestepOut is the response from a prestep
+#PrestepOut: {
+	// Vars are the variables that result from running the prestep, each of
+	// the form NAME=value. NAME must be a valid identifier, because it
+	// is referenced in guides via templates of the form {{.NAME}}.
+	Vars: [...=~"^[A-Za-z_][A-Za-z0-9_]*="]
+
+	// Secrets are the names of those Vars the values of which are secret.
+	// preguide redacts secret values wherever it prints them, and always
+	// sanitises them in output.
+	Secrets: [...string]
+}
+
+// #PrestepServeConfig is the configuration for preguide prestep serve, a
+// stand-in for prestep services. It is a mapping from prestep package path to
+// the responses for that prestep.
+#PrestepServeConfig: [string]: {
+	// Version is the version returned by the prestep
+	Version: *"1" | string
+
+	// Paths is a mapping from the path of a prestep request to the
+	// response to that request
+	Paths: [string]: {
+		// Vars are the variables returned by the prestep. Each is a Go
+		// text/template that is executed with the Args of the request as
+		// data, e.g. "GREETING={{.Message}}".
+		Vars: [...string]
+
+		// Secrets are the names of those Vars that are secret
+		Secrets: [...string]
+	}
 }
 
 // Renderers define what part (or whole) of an upload file should be shown (rendered)
@@ -11,6 +11,7 @@ import (
 	"io/fs"
 	"net/url"
 	"path/filepath"
+	"time"
 
 	"cuelang.org/go/cue"
 	"cuelang.org/go/cue/load"
@@ -19,8 +20,22 @@ import (
 //go:embed preguide.cue out/out.cue cue.mod/module.cue
 var assets goembed.FS
 
+// CUEModule returns the files of the github.com/play-with-go/preguide CUE
+// module (which contains the github.com/play-with-go/preguide and
+// github.com/play-with-go/preguide/out packages), with paths relative to the
+// module root. It allows the module to be written to the cue.mod/pkg directory
+// of another CUE module.
+func CUEModule() fs.FS {
+	return assets
+}
+
+// PrestepOut is the response from a prestep. It is maintained as the
+// #PrestepOut CUE definition.
 type PrestepOut struct {
 	Vars []string
+
+	// Secrets are the names of those Vars the values of which are secret
+	Secrets []string
 }
 
 type GuideStructures map[string]*GuideStructure
@@ -57,6 +72,8 @@ type Scenario struct {
 
 type Schemas struct {
 	PrestepServiceConfig cue.Value
+	PrestepOut           cue.Value
+	PrestepServeConfig   cue.Value
 	Guide                cue.Value
 	Command              cue.Value
 	Upload               cue.Value
@@ -112,6 +129,8 @@ func LoadSchemas(r *cue.Context) (res Schemas, err error) {
 	}
 
 	res.PrestepServiceConfig = mustFind(preguide.LookupPath(cue.ParsePath("#PrestepServiceConfig")))
+	res.PrestepOut = mustFind(preguide.LookupPath(cue.ParsePath("#PrestepOut")))
+	res.PrestepServeConfig = mustFind(preguide.LookupPath(cue.ParsePath("#PrestepServeConfig")))
 	res.Guide = mustFind(preguide.LookupPath(cue.ParsePath("#Guide")))
 	res.Command = mustFind(preguide.LookupPath(cue.ParsePath("#Command")))
 	res.Upload = mustFind(preguide.LookupPath(cue.ParsePath("#Upload")))
@@ -132,18 +151,41 @@ type PrestepServiceConfig map[string]*ServiceConfig
 
 // ServiceConfig defines a URL endpoint where a prestep can be accessed. It
 // also defines optional Docker networks to join when this service is accessed
-// by preguide in a development mode.
+// by preguide in a development mode, and the policy for requests made to the
+// endpoint.
 type ServiceConfig struct {
 	Endpoint *url.URL
 	Env      []string
 	Networks []string
+
+	// Timeout is the timeout for each request. A zero value means no
+	// timeout.
+	Timeout time.Duration
+
+	// Retries is the number of times a request is retried following a
+	// connection error or a 5xx status code, waiting Backoff before the
+	// first retry and doubling the wait for each subsequent retry.
+	Retries int
+	Backoff time.Duration
+
+	// Headers are HTTP headers added to each request
+	Headers map[string]string
+
+	// BearerTokenEnv, if set, is the name of the environment variable the
+	// value of which is sent as a bearer token with each request
+	BearerTokenEnv string
 }
 
 func (p *ServiceConfig) UnmarshalJSON(b []byte) error {
 	var v struct {
-		Endpoint string
-		Env      []string
-		Networks []string
+		Endpoint       string
+		Env            []string
+		Networks       []string
+		Timeout        *string
+		Retries        int
+		Backoff        string
+		Headers        map[string]string
+		BearerTokenEnv string
 	}
 	if err := json.Unmarshal(b, &v); err != nil {
 		return fmt.Errorf("failed to unmarshal prestepConfig: %v", err)
@@ -155,5 +197,20 @@ func (p *ServiceConfig) UnmarshalJSON(b []byte) error {
 	p.Endpoint = u
 	p.Env = v.Env
 	p.Networks = v.Networks
+	if v.Timeout != nil {
+		p.Timeout, err = time.ParseDuration(*v.Timeout)
+		if err != nil {
+			return fmt.Errorf("failed to parse prestepConfig Timeout %q: %v", *v.Timeout, err)
+		}
+	}
+	p.Retries = v.Retries
+	if v.Backoff != "" {
+		p.Backoff, err = time.ParseDuration(v.Backoff)
+		if err != nil {
+			return fmt.Errorf("failed to parse prestepConfig Backoff %q: %v", v.Backoff, err)
+		}
+	}
+	p.Headers = v.Headers
+	p.BearerTokenEnv = v.BearerTokenEnv
 	return nil
 }